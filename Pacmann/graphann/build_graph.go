@@ -93,13 +93,14 @@ func main() {
 
 */
 
-func BuildGraph(n int, dim int, m int, vectors [][]float32, savepath string, dataset string) [][]int {
+func BuildGraph(n int, dim int, m int, vectors [][]float32, savepath string, dataset string, seed int64) [][]int {
 	// First create a HNSW index
 	// we first strip the file extension from input file name
 	ngtFileName := savepath + "/" + dataset + ".ngt"
 	fmt.Println("NGT index file name: ", ngtFileName)
-	graph := CreateGraphBasedOnNGT(vectors, ngtFileName, m)
-	EvaluateGraphQuality(vectors, graph)
+	rng := rand.New(rand.NewSource(seed))
+	graph := CreateGraphBasedOnNGT(vectors, ngtFileName, m, rng.Int63())
+	EvaluateGraphQuality(vectors, graph, rng)
 	return graph
 }
 
@@ -298,7 +299,7 @@ func robustPruneWithOneExtra(vectors [][]float32, u int, neighbors []int, v int,
 	return ret
 }
 
-func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
+func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int, seed int64) [][]int {
 
 	n := len(vectors)
 	dim := len(vectors[0])
@@ -440,7 +441,7 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 		end := min((t+1)*perThreadVertices, n)
 
 		go func(start, end int) {
-			r := rand.New(rand.NewSource(int64(start)))
+			r := rand.New(rand.NewSource(seed + int64(start)))
 			for u := start; u < end; u++ {
 				connection := make([]int, 0)
 				for _, v := range biGraph[u] {
@@ -510,7 +511,8 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 	return graph
 }
 
-func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]int {
+func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int, seed int64) [][]int {
+	rng := rand.New(rand.NewSource(seed))
 
 	start := time.Now()
 
@@ -518,7 +520,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 	alpha := float32(1.2) // the alpha parameter in the robust prune function
 
 	// we enumerate all vertices in a random order
-	perm := rand.Perm(n)
+	perm := rng.Perm(n)
 
 	graph := make([][]int, n)
 	for i := 0; i < n; i++ {
@@ -590,7 +592,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 		for j := 0; j < len(graph[i]); j++ {
 			v := graph[i][j]
 			prob := math.Min(float64(1.5*float64(m))/float64(inbounds[v]), 1.0)
-			if rand.Float64() < prob {
+			if rng.Float64() < prob {
 				keep = append(keep, v)
 			}
 		}
@@ -608,7 +610,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 		for len(graph[i]) < m {
 			// we add a random vertex to the outbounds
 			// make sure it's not i and not already in the outbounds
-			v := rand.Intn(n)
+			v := rng.Intn(n)
 			if v == i {
 				continue
 			}
@@ -761,7 +763,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 }
 */
 
-func EvaluateGraphQuality(vectors [][]float32, graph [][]int) {
+func EvaluateGraphQuality(vectors [][]float32, graph [][]int, rng *rand.Rand) {
 	n := len(vectors)
 	dim := len(vectors[0])
 	m := len(graph[0])
@@ -776,6 +778,7 @@ func EvaluateGraphQuality(vectors [][]float32, graph [][]int) {
 
 	frontend := GraphANNFrontend{
 		Graph: &g,
+		Rand:  rng,
 	}
 
 	frontend.Preprocess()
@@ -789,7 +792,7 @@ func EvaluateGraphQuality(vectors [][]float32, graph [][]int) {
 	avgSteps := 0.0
 
 	for i := 0; i < numQueries; i++ {
-		target := rand.Intn(n)
+		target := rng.Intn(n)
 		//fmt.Println("Query ", i, " target: ", target)
 		knn, steps := frontend.SearchKNN(vectors[target], 20, 20, 2, false)
 		if knn[0] == target {
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,6 +35,7 @@ func main() {
 	//reportFile := flag.String("report", "", "report file name")
 	stepN := flag.Int("step", 15, "searching max depth")
 	parallelN := flag.Int("parallel", 2, "how many parallel vertices are accessed in the same round")
+	seed := flag.Int64("seed", 1, "seed of the graph building and the random queries")
 
 	flag.Parse()
 
@@ -83,7 +85,7 @@ func main() {
 	} else {
 		fmt.Println("Building graph")
 		start := time.Now()
-		graph = graphann.BuildGraph(n, d, m, vectors, workingDir, dataset)
+		graph = graphann.BuildGraph(n, d, m, vectors, workingDir, dataset, *seed)
 		end := time.Now()
 		graphann.SaveGraphToFile(graphFile, graph)
 		fmt.Println("Graph built and saved to file. Time = ", end.Sub(start))
@@ -119,6 +121,7 @@ func main() {
 	}
 
 	frontend := graphann.GraphANNFrontend{
+		Rand: rand.New(rand.NewSource(*seed)),
 		Graph: &graphann.BasicGraphInfo{
 			N:       n,
 			Dim:     d,
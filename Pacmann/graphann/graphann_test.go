@@ -89,14 +89,14 @@ func TestBuildGraphAndSearch(t *testing.T) {
 		}
 	} else {
 		fmt.Println("Building graph")
-		graph = BuildGraph(n, dim, m, vectors, savepath, outputPrefix)
+		graph = BuildGraph(n, dim, m, vectors, savepath, outputPrefix, 1)
 		SaveGraphToFile(graphFile, graph)
 		fmt.Println("Graph built and saved to file")
 	}
 
 	fmt.Println("Graph size: ", len(graph), len(graph[0]))
 	fmt.Println("Evaluating graph quality")
-	EvaluateGraphQuality(vectors, graph)
+	EvaluateGraphQuality(vectors, graph, rand.New(rand.NewSource(1)))
 }
 
 func TestSearchQuality(t *testing.T) {
@@ -135,7 +135,7 @@ func TestSearchQuality(t *testing.T) {
 		}
 	} else {
 		fmt.Println("Building graph")
-		graph = BuildGraph(n, dim, m, vectors, savepath, outputPrefix)
+		graph = BuildGraph(n, dim, m, vectors, savepath, outputPrefix, 1)
 		SaveGraphToFile(graphFile, graph)
 		fmt.Println("Graph built and saved to file")
 	}
@@ -70,6 +70,14 @@ func (g *BasicGraphInfo) GetStartVertex() ([]Vertex, error) {
 type GraphANNFrontend struct {
 	Graph         GetGraphInfo
 	StartVertices []Vertex
+	Rand          *rand.Rand // source of the random queries, nil uses the global one
+}
+
+func (f *GraphANNFrontend) intn(n int) int {
+	if f.Rand == nil {
+		return rand.Intn(n)
+	}
+	return f.Rand.Intn(n)
 }
 
 func (f *GraphANNFrontend) Preprocess() {
@@ -156,7 +164,7 @@ func (g GraphANNFrontend) SearchKNN(queryVector []float32, k int, maxStep int, p
 			if len(toBeExploredVertices) == 0 || benchmarking {
 				// in this case we simply make random queries
 				for i := 0; i < m; i++ {
-					batchQ = append(batchQ, rand.Intn(n))
+					batchQ = append(batchQ, g.intn(n))
 				}
 			} else {
 				item := heap.Pop(&toBeExploredVertices).(*VertexWithDist)
@@ -0,0 +1,282 @@
+package Pacmann
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/dkblackley/bins-go/Pacmann/graphann"
+	"github.com/dkblackley/bins-go/bins"
+	"github.com/dkblackley/bins-go/fusion"
+	"github.com/dkblackley/bins-go/globals"
+	"github.com/dkblackley/bins-go/pianopir"
+	"github.com/sirupsen/logrus"
+)
+
+// Hybrid search. Every query first fetches its bins (lexical), the docs that come back closest to the query embedding
+// seed the graph walk in place of the random sqrt(n) start vertices, and the lexical and graph rankings are fused with
+// reciprocal rank fusion. The graph and the bins live in one PIR DB, so they share one preprocessing and batch budget.
+
+// hybridLayout interleaves the graph and the bins in one PIR DB. The batch PIR cuts its DB into contiguous partitions
+// and every batch queries each of them the same number of times, so if the bins were just put after the graph every
+// bins query would land in the last partition. Instead partition p holds graph rows [p*graphPart, (p+1)*graphPart)
+// followed by bins rows [p*binPart, (p+1)*binPart), padded with empty entries.
+type hybridLayout struct {
+	partitions int
+	graphPart  int
+	binPart    int
+}
+
+func newHybridLayout(graphRows, binRows, partitions int) hybridLayout {
+	return hybridLayout{
+		partitions: partitions,
+		graphPart:  (graphRows + partitions - 1) / partitions,
+		binPart:    (binRows + partitions - 1) / partitions,
+	}
+}
+
+func (l hybridLayout) size() int {
+	return l.partitions * (l.graphPart + l.binPart)
+}
+
+func (l hybridLayout) graphIndex(vertex int) uint64 {
+	return uint64(vertex/l.graphPart*(l.graphPart+l.binPart) + vertex%l.graphPart)
+}
+
+func (l hybridLayout) binIndex(row uint64) uint64 {
+	part := uint64(l.graphPart + l.binPart)
+	return row/uint64(l.binPart)*part + uint64(l.graphPart) + row%uint64(l.binPart)
+}
+
+// combine lays the two DBs out in one.
+func (l hybridLayout) combine(graphDB, binDB [][]uint64) [][]uint64 {
+	rawDB := make([][]uint64, l.size())
+	for i := range rawDB {
+		rawDB[i] = []uint64{}
+	}
+	for v, entry := range graphDB {
+		rawDB[l.graphIndex(v)] = entry
+	}
+	for row, entry := range binDB {
+		rawDB[l.binIndex(uint64(row))] = entry
+	}
+	return rawDB
+}
+
+type HybridInfo struct {
+	graph  *PIRGraphInfo
+	bins   bins.VecBins
+	config globals.Args
+	PIR    *pianopir.SimpleBatchPianoPIR
+}
+
+// HybridMain loads the graph (see PacmannMain) and builds the bins over the same vectors.
+func HybridMain(config globals.Args) *HybridInfo {
+	g := PacmannMain(config)
+	return &HybridInfo{
+		graph:  g,
+		bins:   bins.BuildVecBinsFromVectors(config, g.vectors),
+		config: config,
+	}
+}
+
+func (h *HybridInfo) GetBatchPIRInfo() *pianopir.SimpleBatchPianoPIR {
+	return h.PIR
+}
+
+func (h *HybridInfo) Preprocess() {
+	g := h.graph
+	if g.NonPrivateMode {
+		// Plaintext baseline, the graph and the bins are read directly. The random start vertices aren't used.
+		g.frontend = graphann.GraphANNFrontend{
+			Graph: g,
+			Rand:  g.rng,
+		}
+		return
+	}
+
+	g.encodeDB()
+
+	batchSize := max(g.M, h.bins.BatchSize)
+	layout := newHybridLayout(len(g.rawDB), len(h.bins.RawDB()), batchSize/pianopir.RealQueryPerPartition)
+	rawDB := layout.combine(g.rawDB, h.bins.RawDB())
+
+	// Entries are padded to the bigger of the two, in a size the bins can still be decoded at
+	maxWords := h.bins.PaddedEntryWords(uint64(len(g.rawDB[0])))
+	logrus.Debugf("Hybrid DB: %d graph rows and %d bins rows in %d entries of %d words", len(g.rawDB),
+		len(h.bins.RawDB()), len(rawDB), maxWords)
+
+	// Per query: one batch for the bins, one for the seeds and then the graph walk
+	h.PIR = pianopir.NewSimpleBatchPianoPIR(uint64(len(rawDB)), maxWords, maxWords*8, uint64(batchSize), rawDB, 40,
+		uint64(g.stepN)*uint64(pianopir.ThreadNum)+12)
+
+	if g.skipPrep {
+		h.PIR.DummyPreprocessing()
+	} else if err := h.PIR.PreprocessingFrom(g.pirState); err != nil {
+		panic(err)
+	}
+
+	g.PIR = h.PIR
+	g.pirIndex = layout.graphIndex
+	h.bins.PIR = h.PIR
+	h.bins.PIRIndex = layout.binIndex
+
+	g.frontend = graphann.GraphANNFrontend{
+		Graph: g,
+		Rand:  g.rng,
+	}
+}
+
+// SetNonPrivateMode switches both the bins and the graph between PIR and plaintext.
+func (h *HybridInfo) SetNonPrivateMode(nonPrivate bool) {
+	h.graph.SetNonPrivateMode(nonPrivate)
+	h.bins.SetNonPrivateMode(nonPrivate)
+}
+
+// RandSeed draws a seed, restarts the random vertices and the dummy indices of the bins from it and returns it.
+func (h *HybridInfo) RandSeed() int64 {
+	seed := h.graph.RandSeed()
+	h.SetRandSeed(seed)
+	return seed
+}
+
+// SetRandSeed restarts the random vertices from seed and the dummy indices of the bins from a seed drawn from it.
+func (h *HybridInfo) SetRandSeed(seed int64) {
+	h.graph.SetRandSeed(seed)
+	h.bins.SetRandSeed(rand.New(rand.NewSource(seed)).Int63())
+}
+
+// hybridResult is the lexical and the graph ranking of a query, best first, as rows of the corpus vectors (which are
+// the vertices of the graph). They are mapped to doc IDs and fused when decoding.
+type hybridResult struct {
+	lexical []int
+	dense   []int
+}
+
+// hybridResultGob is hybridResult with its fields exported, so gob can write it.
+type hybridResultGob struct {
+	Lexical []int
+	Dense   []int
+}
+
+func (r hybridResult) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(hybridResultGob{r.lexical, r.dense})
+	return buf.Bytes(), err
+}
+
+func (r *hybridResult) GobDecode(data []byte) error {
+	var g hybridResultGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*r = hybridResult{g.Lexical, g.Dense}
+	return nil
+}
+
+func (r hybridResult) Decode(config globals.Args) []string {
+	docIDs, _ := r.DecodeScored(config)
+	return docIDs
+}
+
+// DecodeScored returns the top config.K fused docs with their RRF scores.
+func (r hybridResult) DecodeScored(config globals.Args) ([]string, []float64) {
+	rankings := make([][]string, 2)
+	for i, rows := range [][]int{r.lexical, r.dense} {
+		rankings[i] = make([]string, len(rows))
+		for j, row := range rows {
+			rankings[i][j] = config.DocID(row)
+		}
+	}
+	docIDs, scores := fusion.RRFRankings(rankings)
+	n := min(len(docIDs), int(config.K))
+	return docIDs[:n], scores[:n]
+}
+
+func (h *HybridInfo) DoSearch(QID string, k int) (globals.Decodable, error) {
+	g := h.graph
+
+	query, exists := g.queryMap[QID]
+	if !exists {
+		logrus.Errorf("QID not found in file?? %s", QID)
+		return nil, errors.New("query not found")
+	}
+
+	decodable, err := h.bins.DoSearch(QID, k)
+	if err != nil {
+		return nil, err
+	}
+	candidates := decodable.(bins.DBentry).Candidates(h.config)
+
+	seeds, err := h.seedVertices(query, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	frontend := g.frontend
+	frontend.StartVertices = seeds
+	vertexIds, _ := frontend.SearchKNN(query, k, g.stepN, pianopir.ThreadNum, false)
+
+	result := hybridResult{
+		lexical: make([]int, len(candidates)),
+		dense:   make([]int, 0, len(vertexIds)),
+	}
+	for i, c := range candidates {
+		result.lexical[i] = int(c.Doc)
+	}
+	for _, id := range vertexIds {
+		if id >= 0 { // -1 if the walk found fewer than k
+			result.dense = append(result.dense, id)
+		}
+	}
+
+	return result, nil
+}
+
+// seedVertices fetches the vertices of the pianopir.ThreadNum lexical candidates closest to the query, which is all
+// SearchKNN starts from. The batch is topped up with random vertices if the bins came back (nearly) empty, so its size
+// doesn't depend on the query.
+func (h *HybridInfo) seedVertices(query []float32, candidates []bins.Candidate) ([]graphann.Vertex, error) {
+	g := h.graph
+
+	// Closest first, without touching the lexical order of candidates
+	dists := make([]float32, len(candidates))
+	order := make([]int, len(candidates))
+	for i, c := range candidates {
+		dists[i] = graphann.L2Dist(c.Vector, query)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return dists[order[i]] < dists[order[j]]
+	})
+
+	ids := make([]int, 0, pianopir.ThreadNum)
+	added := make(map[int]bool)
+	for _, i := range order {
+		c := candidates[i]
+		if len(ids) == pianopir.ThreadNum {
+			break
+		}
+		// The bins hold the row of each doc in the corpus vectors, which is its vertex
+		id := int(c.Doc)
+		if id >= g.N {
+			return nil, fmt.Errorf("bins returned doc %s in row %d, which is not a vertex", c.DocID, id)
+		}
+		if !added[id] {
+			added[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for len(ids) < min(pianopir.ThreadNum, g.N) {
+		x := g.rng.Intn(g.N)
+		if !added[x] {
+			added[x] = true
+			ids = append(ids, x)
+		}
+	}
+
+	return g.GetVertexInfo(ids)
+}
@@ -1,16 +1,16 @@
 package Pacmann
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/gob"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -33,6 +33,9 @@ var dim int
 var m int
 var k int
 
+// neighborNum is the out degree of the graph
+const neighborNum = 32
+
 // var q int
 
 var PIR *pianopir.SimpleBatchPianoPIR
@@ -43,27 +46,27 @@ var PIR *pianopir.SimpleBatchPianoPIR
 
 //const graphFile = "graph100.txt"
 
-func genRandomMatrix(n int, dim int) [][]float32 {
+func genRandomMatrix(rng *rand.Rand, n int, dim int) [][]float32 {
 	ret := make([][]float32, n)
 
 	for i := 0; i < n; i++ {
 		ret[i] = make([]float32, dim)
 		for j := 0; j < dim; j++ {
-			ret[i][j] = rand.Float32()
+			ret[i][j] = rng.Float32()
 		}
 	}
 	return ret
 }
 
-func genRandomGraph(n int, m int) [][]int {
+func genRandomGraph(rng *rand.Rand, n int, m int) [][]int {
 	ret := make([][]int, n)
 	for i := 0; i < n; i++ {
 		ret[i] = make([]int, m)
 		for j := 0; j < m; j++ {
-			k := rand.Intn(n)
+			k := rng.Intn(n)
 			for k == i {
 				// no self loop
-				k = rand.Intn(n)
+				k = rng.Intn(n)
 			}
 			ret[i][j] = k
 		}
@@ -75,11 +78,9 @@ func genRandomGraph(n int, m int) [][]int {
 func PacmannMain(args globals.Args) *PIRGraphInfo {
 	numVectors := args.DBSize
 	dimVectors := args.Dimensions
-	neighborNum := 32
 	outputNum := args.K
 	queryNum := args.QueryNum //TODO: make this a command line argument?
 	inputFile := args.DatasetMeta.Vectors.CorpusVec
-	graphFile := args.DatasetMeta.Vectors.Graph
 	queryFile := args.DatasetMeta.Vectors.QueryVec
 	//outputFile := args.DatasetsDirectory + "_pacmann_output.npy"
 	//gndFile := "" //TODO: we don't need this for MSmarco/test datasets
@@ -90,20 +91,15 @@ func PacmannMain(args globals.Args) *PIRGraphInfo {
 	//rtt := args.RTT
 	// nonPrivate := false // Debug mode - I don't think this'll work anymore!
 
-	flag.Parse()
-
 	n = int(numVectors)
 	dim = int(dimVectors)
 	m = neighborNum
 	k = int(outputNum)
 	// q = queryNum
-	nonPrivateMode = false
-	workingDir := filepath.Dir(inputFile)
+	nonPrivateMode = !args.Private
+	rng := rand.New(rand.NewSource(args.Seed))
+	graphFileName, workingDir, dataset := graphPaths(args)
 	fmt.Println("Working directory: ", workingDir)
-	dataName := filepath.Base(inputFile)
-	dataName = strings.TrimSuffix(dataName, filepath.Ext(dataName))
-	fmt.Println("Data name: ", dataName)
-	dataset := dataName + fmt.Sprintf("_%d_%d_%d", n, dim, m)
 	fmt.Println("Dataset name: ", dataset)
 
 	// step 1: load vector
@@ -114,7 +110,7 @@ func PacmannMain(args globals.Args) *PIRGraphInfo {
 
 	if inputFile == "synthetic" {
 		syntheticTest = true
-		vectors = genRandomMatrix(n, dim)
+		vectors = genRandomMatrix(rng, n, dim)
 		log.Printf("Generated synthetic data with n=%d, dim=%d\n", n, dim)
 	} else {
 		// it means we need to read the file
@@ -129,31 +125,14 @@ func PacmannMain(args globals.Args) *PIRGraphInfo {
 	// step 2: load graph. If not exists, generate the graph
 
 	graph = make([][]int, n)
-	graphFileName := graphFile
 	if syntheticTest {
-		graph = genRandomGraph(n, m)
+		graph = genRandomGraph(rng, n, m)
 		log.Print("Generated synthetic graph...")
 	} else {
-		if graphFile == "" {
-			// we will use the default name
-			graphFileName = filepath.Join(workingDir, dataset+"_graph.npy")
-		}
-
 		if _, err := os.Stat(graphFileName); os.IsNotExist(err) {
 			// in this case we need to generate the graph
 			log.Printf("Graph file %s does not exist. Generating the graph...\n", graphFileName)
-			start := time.Now()
-			graph = graphann.BuildGraph(n, dim, m, vectors, workingDir, dataset)
-			end := time.Now()
-			graphann.SaveGraphToFile(graphFileName, graph)
-			log.Printf("Graph generation time: %v\n", end.Sub(start))
-
-			// we write the graph generation time to an auxiliary file
-
-			auxFileName := filepath.Join(workingDir, dataset+"_graph_aux.txt")
-			auxFile, _ := os.Create(auxFileName)
-			fmt.Fprintf(auxFile, "Dataset: %s\n", dataset)
-			fmt.Fprintf(auxFile, "Graph generation time: %v\n", end.Sub(start))
+			buildGraph(graphFileName, workingDir, dataset, rng.Int63())
 		} else {
 			log.Printf("Loading graph from file %s\n", graphFileName)
 			graph, err = graphann.LoadIntMatrixFromFile(graphFileName, n, m)
@@ -168,7 +147,7 @@ func PacmannMain(args globals.Args) *PIRGraphInfo {
 
 	queries = make([][]float32, q)
 	if syntheticTest {
-		queries = genRandomMatrix(q, dim)
+		queries = genRandomMatrix(rng, q, dim)
 		log.Print("Generated synthetic queries...")
 	} else {
 		if queryFile == "" {
@@ -207,6 +186,8 @@ func PacmannMain(args globals.Args) *PIRGraphInfo {
 		queries:        queries,
 		queryMap:       queryMap,
 		stepN:          stepN,
+		rng:            rng,
+		pirState:       args.PIRState,
 	}
 
 	return queryEngine
@@ -336,6 +317,9 @@ type PIRGraphInfo struct {
 	rawDB          [][]uint64
 	PIR            *pianopir.SimpleBatchPianoPIR
 	stepN          int // number of steps while searching
+	// maps a vertex onto its PIR index when the graph shares a PIR DB with something else (hybrid search), nil means
+	// the vertex ID is the index
+	pirIndex func(vertex int) uint64
 
 	// some stats
 	totalQueryNum int
@@ -343,20 +327,91 @@ type PIRGraphInfo struct {
 	queries       [][]float32
 	queryMap      map[string][]float32
 	frontend      graphann.GraphANNFrontend
+	rng           *rand.Rand // seeded with -seed, for the start vertices, the PIR and the frontend's random queries
+	pirState      []byte     // loaded by Preprocess in place of the offline phase, see globals.Args
+}
+
+// graphPaths is where the graph of args' corpus vectors is kept (the dataset's graph, or a default name next to the
+// vectors), the directory the graph is built in and the name it is built under.
+func graphPaths(args globals.Args) (graphFileName, workingDir, dataset string) {
+	inputFile := args.DatasetMeta.Vectors.CorpusVec
+	workingDir = filepath.Dir(inputFile)
+	dataName := filepath.Base(inputFile)
+	dataName = strings.TrimSuffix(dataName, filepath.Ext(dataName))
+	dataset = dataName + fmt.Sprintf("_%d_%d_%d", args.DBSize, args.Dimensions, neighborNum)
+
+	graphFileName = args.DatasetMeta.Vectors.Graph
+	if graphFileName == "" {
+		// we will use the default name
+		graphFileName = filepath.Join(workingDir, dataset+"_graph.npy")
+	}
+	return graphFileName, workingDir, dataset
+}
+
+// buildGraph builds the graph of vectors and saves it to graphFileName.
+func buildGraph(graphFileName, workingDir, dataset string, seed int64) {
+	start := time.Now()
+	graph = graphann.BuildGraph(n, dim, m, vectors, workingDir, dataset, seed)
+	end := time.Now()
+	graphann.SaveGraphToFile(graphFileName, graph)
+	log.Printf("Graph generation time: %v\n", end.Sub(start))
+
+	// we write the graph generation time to an auxiliary file
+
+	auxFileName := filepath.Join(workingDir, dataset+"_graph_aux.txt")
+	auxFile, _ := os.Create(auxFileName)
+	fmt.Fprintf(auxFile, "Dataset: %s\n", dataset)
+	fmt.Fprintf(auxFile, "Graph generation time: %v\n", end.Sub(start))
+	auxFile.Close()
+}
+
+// BuildGraph builds the graph of the corpus vectors and saves it where PacmannMain loads it from, replacing any graph
+// that is already there. It returns the graph file.
+func BuildGraph(args globals.Args) string {
+	n = int(args.DBSize)
+	dim = int(args.Dimensions)
+	m = neighborNum
+	graphFileName, workingDir, dataset := graphPaths(args)
+
+	log.Print("Loading vectors from file: ", args.DatasetMeta.Vectors.CorpusVec)
+	var err error
+	vectors, err = globals.LoadFloat32MatrixFromNpy(args.DatasetMeta.Vectors.CorpusVec, n, dim)
+	if err != nil {
+		log.Fatalf("Error reading the input file: %v", err)
+	}
+
+	buildGraph(graphFileName, workingDir, dataset, args.Seed)
+	return graphFileName
 }
 
 type vertexIDs struct {
 	vertices []int
 }
 
+func init() {
+	// the search stage saves them, see globals.SaveEncodedAnswers
+	gob.Register(vertexIDs{})
+	gob.Register(hybridResult{})
+}
+
+func (v vertexIDs) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v.vertices)
+	return buf.Bytes(), err
+}
+
+func (v *vertexIDs) GobDecode(data []byte) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&v.vertices)
+}
+
 func (v vertexIDs) Decode(config globals.Args) []string {
-	// Because we build the graph in the same order as wel laod the vertices, the vertex IDs SHOULD be the same as the
-	// matching docID at the same row..... In msmarco they're labelled in ascending order, so we just assume they're correct!!
+	// Because we build the graph in the same order as wel laod the vertices, a vertex is the row of its doc in the
+	// corpus vectors, config.DocIDs has the doc ID of that row.
 
 	finalIDs := make([]string, len(v.vertices))
 
 	for i, vertex := range v.vertices {
-		finalIDs[i] = strconv.Itoa(vertex)
+		finalIDs[i] = config.DocID(vertex)
 	}
 
 	return finalIDs
@@ -447,9 +502,47 @@ func (g *PIRGraphInfo) GetBatchPIRInfo() *pianopir.SimpleBatchPianoPIR {
 }
 
 func (g *PIRGraphInfo) Preprocess() {
+	if g.NonPrivateMode {
+		// Plaintext baseline, GetVertexInfo reads the graph directly so there is no DB to build
+		g.frontend = graphann.GraphANNFrontend{
+			Graph: g,
+			Rand:  g.rng,
+		}
+		v, err := g.GetStartVertex()
+		if err != nil {
+			panic(err)
+		}
+		g.frontend.StartVertices = v
+		return
+	}
+
+	g.encodeDB()
+
 	// now we set up the PIR
-	// first step, we need to convert the matrix and graph into a rawDB
+	g.PIR = pianopir.NewSimpleBatchPianoPIR(uint64(g.N), uint64(len(g.rawDB[0])), g.DBEntryByteNum,
+		uint64(len(g.graph[0])), g.rawDB, 40, uint64(g.stepN)*uint64(pianopir.ThreadNum)+10)
 
+	if g.skipPrep {
+		g.PIR.DummyPreprocessing()
+	} else if err := g.PIR.PreprocessingFrom(g.pirState); err != nil {
+		panic(err)
+	}
+
+	// Watch this pointer :c
+	g.frontend = graphann.GraphANNFrontend{
+		Graph: g,
+		Rand:  g.rng,
+	}
+
+	v, err := g.GetStartVertex()
+	if err != nil {
+		panic(err)
+	}
+	g.frontend.StartVertices = v
+}
+
+// encodeDB converts the matrix and graph into a rawDB, one entry (vector then neighbors) per vertex.
+func (g *PIRGraphInfo) encodeDB() {
 	N := g.N
 	Dim := g.Dim
 	M := g.M
@@ -495,27 +588,23 @@ func (g *PIRGraphInfo) Preprocess() {
 	//fmt.Println("DB size: ", len(rawDB))
 	g.DBEntryByteNum = DBEntryByteNum
 	g.DBTotalSize = uint64(N) * DBEntryByteNum
+}
 
-	// now we set up the PIR
-	g.PIR = pianopir.NewSimpleBatchPianoPIR(uint64(g.N), uint64(len(g.rawDB[0])), g.DBEntryByteNum,
-		uint64(len(g.graph[0])), g.rawDB, 40, uint64(g.stepN)*uint64(pianopir.ThreadNum)+10)
-
-	if g.skipPrep {
-		g.PIR.DummyPreprocessing()
-	} else {
-		g.PIR.Preprocessing()
-	}
+// SetNonPrivateMode switches between fetching vertices through PIR and reading them in plaintext.
+func (g *PIRGraphInfo) SetNonPrivateMode(nonPrivate bool) {
+	g.NonPrivateMode = nonPrivate
+}
 
-	// Watch this pointer :c
-	g.frontend = graphann.GraphANNFrontend{
-		Graph: g,
-	}
+// RandSeed draws a seed, restarts the random vertices from it and returns it. SetRandSeed with it carries on the same.
+func (g *PIRGraphInfo) RandSeed() int64 {
+	seed := g.rng.Int63()
+	g.rng.Seed(seed)
+	return seed
+}
 
-	v, err := g.GetStartVertex()
-	if err != nil {
-		panic(err)
-	}
-	g.frontend.StartVertices = v
+// SetRandSeed restarts the random vertices from a seed RandSeed returned.
+func (g *PIRGraphInfo) SetRandSeed(seed int64) {
+	g.rng.Seed(seed)
 }
 
 func (g *PIRGraphInfo) GetMetadata() (int, int, int) {
@@ -567,6 +656,9 @@ func (g *PIRGraphInfo) GetVertexInfo(vertexIds []int) ([]graphann.Vertex, error)
 	indices := make([]uint64, len(vertexIds))
 	for i := 0; i < len(vertexIds); i++ {
 		indices[i] = uint64(vertexIds[i])
+		if g.pirIndex != nil {
+			indices[i] = g.pirIndex(vertexIds[i])
+		}
 	}
 
 	responses, err := g.PIR.Query(indices)
@@ -623,9 +715,9 @@ func (g *PIRGraphInfo) GetStartVertex() ([]graphann.Vertex, error) {
 	batch := make([]int, targetNum)
 	ret := make([]graphann.Vertex, targetNum)
 	for i := 0; i < targetNum; i++ {
-		x := rand.Intn(n)
+		x := g.rng.Intn(n)
 		for added[x] {
-			x = rand.Intn(n)
+			x = g.rng.Intn(n)
 		}
 		added[x] = true
 		batch[i] = x
@@ -1,10 +1,14 @@
 package bins
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
-	"math"
-	"strconv"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/blugelabs/bluge"
 	"github.com/blugelabs/bluge/analysis"
@@ -15,18 +19,38 @@ import (
 )
 
 type VecBins struct {
-	N                    int              // Number of Bins
-	Dimensions           int              // Dimension of vectors
-	EntrySize            int              // number of vectors in a row (Size of one entry)
-	DBEntrySize          uint64           // Number of bytes in an entry
-	DBTotalSize          uint64           // in bytes
-	Queries              map[string]Query // A mapping from QID to query
-	EnglishTokenAnalyzer *analysis.Analyzer
-	PIR                  *pianopir.SimpleBatchPianoPIR
-	MaxRowSize           uint
-
-	rawDB  [][]uint64
-	config globals.Args
+	N             int              // Number of Bins
+	Dimensions    int              // Dimension of vectors
+	EntrySize     int              // number of vectors in a row (Size of one entry)
+	DBEntrySize   uint64           // Number of bytes in an entry
+	DBTotalSize   uint64           // in bytes
+	Queries       map[string]Query // A mapping from QID to query
+	TokenAnalyzer *analysis.Analyzer
+	PIR           *pianopir.SimpleBatchPianoPIR
+	MaxRowSize    uint
+	Keyword       bool      // Entries are laid out in a cuckoo table with key tags, see keyword_pir.go
+	DChoice       uint      // Number of candidate bins per token
+	Layout        binLayout // How bins map onto PIR rows once the overflow policy has run
+	// Published placement hint (token -> which of its candidate bins holds it). If nil, the client queries all DChoice
+	// candidates of every token.
+	Placement  map[string]uint
+	ScoreScale float64 // BM25 score of a quantised score of 1
+	Ngram      uint    // Longest n-gram in the bins (1 for unigrams only)
+	// Every query sends exactly this many PIR indices, see query_budget.go. 0 sends every term unpadded.
+	BatchSize   int
+	TokenPolicy string    // Which query terms to keep when they don't all fit in the batch
+	Stats       termStats // Doc frequencies the token policy ranks terms by
+	// Maps a row of the bins onto an index of PIR, for when the bins share a PIR DB with something else (hybrid
+	// search). nil means the bins are the whole DB.
+	PIRIndex func(row uint64) uint64
+	// Read the bins straight out of the DB instead of through PIR, as the plaintext baseline. The answers must be the
+	// same as the private ones.
+	NonPrivateMode bool
+	Rand           *rand.Rand // Source of the dummy indices that pad a batch, seeded with config.Seed
+
+	rawDB    [][]uint64
+	pirState []byte // config.PIRState, loaded by Preprocess in place of the offline phase
+	config   globals.Args
 }
 
 func (v VecBins) GetBatchPIRInfo() *pianopir.SimpleBatchPianoPIR {
@@ -34,25 +58,111 @@ func (v VecBins) GetBatchPIRInfo() *pianopir.SimpleBatchPianoPIR {
 }
 
 func (v VecBins) Preprocess() {
-	v.PIR.Preprocessing()
+	if v.PIR == nil { // -private=false
+		return
+	}
+	Must(v.PIR.PreprocessingFrom(v.pirState))
+}
+
+// RandSeed draws a seed, restarts the dummy indices from it and returns it. SetRandSeed with it carries on the same.
+func (v VecBins) RandSeed() int64 {
+	seed := v.Rand.Int63()
+	v.Rand.Seed(seed)
+	return seed
+}
+
+// SetRandSeed restarts the dummy indices from a seed RandSeed returned.
+func (v VecBins) SetRandSeed(seed int64) {
+	v.Rand.Seed(seed)
 }
 
+// SetNonPrivateMode switches between fetching bins through PIR and reading them in plaintext.
+func (v *VecBins) SetNonPrivateMode(nonPrivate bool) {
+	v.NonPrivateMode = nonPrivate
+}
+
+// DBentry holds the PIR results of one query. tokens[i] is the query token that entry[i] was fetched for.
 type DBentry struct {
-	entry [][]uint64
+	entry      [][]uint64
+	tokens     []string
+	scoreScale float64
+}
+
+func init() {
+	gob.Register(DBentry{}) // the search stage saves them, see globals.SaveEncodedAnswers
+}
+
+// dbEntryGob is DBentry with its fields exported, so gob can write it.
+type dbEntryGob struct {
+	Entry      [][]uint64
+	Tokens     []string
+	ScoreScale float64
+}
+
+func (d DBentry) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(dbEntryGob{d.entry, d.tokens, d.scoreScale})
+	return buf.Bytes(), err
+}
+
+func (d *DBentry) GobDecode(data []byte) error {
+	var g dbEntryGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*d = DBentry{g.Entry, g.Tokens, g.ScoreScale}
+	return nil
 }
 
 func (d DBentry) Decode(config globals.Args) []string {
+	docIDs, _ := d.DecodeScored(config)
+	return docIDs
+}
+
+// DecodeScored ranks the docs in the results locally, see Candidates. Returns the top config.K doc IDs and their scores,
+// best first.
+func (d DBentry) DecodeScored(config globals.Args) ([]string, []float64) {
+	candidates := d.Candidates(config)
+	if config.K > 0 && len(candidates) > int(config.K) {
+		candidates = candidates[:config.K]
+	}
+
+	docIDs := make([]string, len(candidates))
+	ranked := make([]float64, len(candidates))
+	for i, c := range candidates {
+		docIDs[i] = c.DocID
+		ranked[i] = c.Score
+	}
+	return docIDs, ranked
+}
+
+// Candidate is one doc that came back in the bins of a query.
+type Candidate struct {
+	DocID  string
+	Doc    uint32  // its row in the corpus vectors (and its vertex in the graph)
+	Score  float64 // BM25 score, summed over the query tokens
+	Vector []float32
+}
+
+// Candidates decodes every doc in the results. Each doc gets its best score for every query token (a token can fetch
+// more than one row) and those are summed over the tokens, like BM25 does for a multi-term query. Sorted best first.
+//
+// This is an approximation when terms collide: a bin holds one row per doc, with the best score any term placed in
+// the bin gave it (see fillBins), so a token is credited with that score whether it was its own or not, and with the
+// docs of the other terms. The score is an upper bound of the token's BM25 score, exact unless a term sharing its bin
+// scores the doc higher. Keeping a score per (term, doc) would cost a row for every term of a doc that lands in the bin.
+func (d DBentry) Candidates(config globals.Args) []Candidate {
 
 	results := d.entry // This might literally always be of size 1. But hey, it works I guess
 	empty := 0
 
-	docIDs := make([]string, 0)
-
-	IDLookup := config.IDLookup
+	tokenScores := make(map[string]map[string]uint16)
+	vectors := make(map[string][]float32)
+	docs := make(map[string]uint32)
 
 	for i := 0; i < len(results); i++ {
 		singleResult := results[i]
-		if len(singleResult) == 1 {
+		if len(singleResult) <= 1 {
 			logrus.Warnf("Got an empty result: %v - Possibly missed and entry", singleResult)
 			empty++
 			if empty == len(results) {
@@ -61,74 +171,192 @@ func (d DBentry) Decode(config globals.Args) []string {
 			}
 			continue
 		}
-		//if config.SearchType == "Pacmann" {
-		//	multipleVectors = // TODO: DOES SINGLERESULT ONLY HAVE ONE VECTOR??
-		//} else {
-		multipleVectors, err := DecodeEntryToVectors(singleResult, int(config.Dimensions))
+		rows, err := DecodeEntryToRows(singleResult, int(config.Dimensions))
 		Must(err)
 
-		// TODO: Remove this when not debug
-		//if len(multipleVectors) > 0 {
-		//	// Check if the first vector is all zeros
-		//	isZero := true
-		//	for _, val := range multipleVectors[0] {
-		//		if val != 0 {
-		//			isZero = false
-		//			break
-		//		}
-		//	}
-		//	if isZero {
-		//		logrus.Warnf("WARNING: Decoded vector is ALL ZEROS for QID %s", qid)
-		//	}
-		//}
+		token := d.tokens[i]
+		if tokenScores[token] == nil {
+			tokenScores[token] = make(map[string]uint16)
+		}
 
-		for j := 0; j < len(multipleVectors); j++ {
-			ID := HashFloat32s(multipleVectors[j])
-			docID, ok := IDLookup[ID]
-			if !ok {
-				logrus.Warnf("Vector hash not found: %s", ID)
-				continue
-			}
-			docIDs = append(docIDs, docID)
+		for _, row := range rows {
+			docID := config.DocID(int(row.Doc))
+			tokenScores[token][docID] = max(tokenScores[token][docID], row.Score)
+			vectors[docID] = row.Vector
+			docs[docID] = row.Doc
+		}
+	}
 
+	scores := make(map[string]float64)
+	for _, docs := range tokenScores {
+		for docID, q := range docs {
+			scores[docID] += float64(q) * d.scoreScale
 		}
 	}
-	return docIDs
+
+	candidates := make([]Candidate, 0, len(scores))
+	for docID, score := range scores {
+		candidates = append(candidates, Candidate{docID, docs[docID], score, vectors[docID]})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].DocID < candidates[j].DocID
+	})
+	return candidates
 }
 
 func (v VecBins) DoSearch(QID string, _ int) (globals.Decodable, error) {
-	indices := v.MakeIndices(QID)
+	if v.Keyword {
+		return v.doKeywordSearch(QID)
+	}
 
-	if uint64(len(indices)) >= 32 { // TODO: pass batchsize in args to checl
-		logrus.Warnf("Too many indices in batch: %d for QID: %s - Possible corruption incoming", len(indices), QID)
+	indices, terms := v.MakeIndices(QID)
+
+	results, err := v.query(indices)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hand every result to each term it was fetched for, dummies get dropped here
+	entry := make([][]uint64, 0, len(results))
+	tokens := make([]string, 0, len(results))
+	for i, result := range results {
+		for _, term := range terms[i] {
+			entry = append(entry, result)
+			tokens = append(tokens, term)
+		}
 	}
-	results, err := v.PIR.Query(indices)
 
 	//TODO: something with K
 	return DBentry{
-		results,
-	}, err
+		entry:      entry,
+		tokens:     tokens,
+		scoreScale: v.ScoreScale,
+	}, nil
 }
 
-func (v VecBins) MakeIndices(QID string) []uint64 {
+func (v VecBins) doKeywordSearch(QID string) (globals.Decodable, error) {
+	b := v.fillBatch(QID, func(term string) []uint64 { return keywordSlots(term, v.N) })
+
+	found, err := v.keywordFetch(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted so the decoded order doesn't depend on map order
+	tokens := make([]string, 0, len(found))
+	for token := range found {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
 
+	results := make([][]uint64, len(tokens))
+	for i, token := range tokens {
+		results[i] = found[token]
+	}
+	logrus.Tracef("QID %s: %d tokens found", QID, len(results))
+
+	return DBentry{
+		entry:      results,
+		tokens:     tokens,
+		scoreScale: v.ScoreScale,
+	}, nil
+}
+
+// queryTokens runs the query text through the same analyzer that was used to build the bins.
+func (v VecBins) queryTokens(QID string) []string {
 	query := v.Queries[QID]
 
-	tokeniser := strictEnglishAnalyzer()
-	tokens := tokeniser.Analyze([]byte(query.Text))
+	tokens := v.TokenAnalyzer.Analyze([]byte(query.Text))
 
-	indices := make([]uint64, len(tokens))
+	terms := make([]string, len(tokens))
 	for i, t := range tokens {
-		indices[i] = hashTokenChoice(fmt.Sprintf("%s", t.Term), v.config.DChoice) % uint64(v.N)
+		terms[i] = string(t.Term)
+	}
+	return terms
+}
+
+// MakeIndices returns the distinct PIR rows to fetch for a query, along with the terms each row is fetched for (nil
+// for the dummies that pad the batch to v.BatchSize). See fillBatch for which terms make it in.
+func (v VecBins) MakeIndices(QID string) ([]uint64, [][]string) {
+	b := v.fillBatch(QID, func(term string) []uint64 { return v.termRows(term, QID) })
+	return b.indices, b.terms
+}
+
+// termRows returns the PIR rows a term's docs could be in: every row of every candidate bin, or only the rows of the
+// bin the placement hint points at (none if the term isn't in the hint).
+func (v VecBins) termRows(term string, QID string) []uint64 {
+	candidates := binCandidates(term, v.DChoice, uint(v.Layout.Bins))
+
+	if v.Placement == nil {
+		rows := make([]uint64, 0)
+		for _, bin := range candidates {
+			rows = append(rows, v.Layout.rows(bin)...)
+		}
+		return rows
 	}
 
-	return indices
+	choice, ok := v.Placement[term]
+	if !ok {
+		// Not in the vocab, so it isn't in any bin
+		logrus.Tracef("Token %q of QID %s has no placement", term, QID)
+		return nil
+	}
+	return v.Layout.rows(candidates[choice])
+}
+
+// query runs a PIR batch over rows of the bins (or just reads them, in NonPrivateMode).
+func (v VecBins) query(rows []uint64) ([][]uint64, error) {
+	if v.NonPrivateMode {
+		// Padded with zeros to the width of a PIR entry, so an empty bin decodes to no rows like a private one does
+		width := int(v.DBEntrySize+7) / 8
+		entries := make([][]uint64, len(rows))
+		for i, row := range rows {
+			entries[i] = make([]uint64, max(width, len(v.rawDB[row])))
+			copy(entries[i], v.rawDB[row])
+		}
+		return entries, nil
+	}
+	if v.PIRIndex == nil {
+		return v.PIR.Query(rows)
+	}
+	indices := make([]uint64, len(rows))
+	for i, row := range rows {
+		indices[i] = v.PIRIndex(row)
+	}
+	return v.PIR.Query(indices)
+}
+
+// PaddedEntryWords is the smallest entry size (in uint64s) of at least minWords that the bins entries still decode at,
+// for when they share a PIR DB whose entries are bigger than their own.
+func (v VecBins) PaddedEntryWords(minWords uint64) uint64 {
+	words := (v.DBEntrySize + 7) / 8
+	for words < minWords {
+		words += uint64(rowWords(v.Dimensions))
+	}
+	return words
+}
 
+// RawDB is the encoded bins, one PIR entry per row.
+func (v VecBins) RawDB() [][]uint64 {
+	return v.rawDB
 }
 
 // MakeVecDb Takes in args from command line and then outputs a 'VecBins' object that implements the functions required for
 // binsDB.
 func MakeVecDb(config globals.Args) VecBins {
+	binPir := BuildVecBins(config)
+	if config.Private {
+		binPir.PIR = newBinsPIR(binPir)
+		binPir.pirState = config.PIRState
+	}
+	return binPir
+}
+
+// BuildVecBins builds (or loads) the bins and encodes them, but doesn't set up a PIR for them.
+func BuildVecBins(config globals.Args) VecBins {
 
 	metaData := config.DatasetMeta
 
@@ -139,25 +367,53 @@ func MakeVecDb(config globals.Args) VecBins {
 	bm25Vectors, err := globals.LoadFloat32MatrixFromNpy(metaData.Vectors.CorpusVec, int(config.DBSize), int(config.Dimensions))
 	logrus.Infof("Size of vectors: %d", len(bm25Vectors))
 	Must(err)
-	var DB [][]string
-	if config.Load {
-		// TODO: make this dynamic
-		DB, err = ReadCSV(config.DataName + "_unigram_DB.csv")
-		Must(err)
-		logrus.Debugf("Loaded DB with %d items from %s", len(DB), config.DataName+"_unigram_DB.csv")
 
-	} else {
-		reader, _ := bluge.OpenReader(bluge.DefaultConfig(metaData.IndexDir))
-		defer reader.Close()
-		DB = MakeUnigramDB(reader, metaData, config)
-		Must(err)
+	return BuildVecBinsFromVectors(config, bm25Vectors)
+}
 
+// BuildVecBinsFromVectors is BuildVecBins for when the corpus vectors are already loaded.
+func BuildVecBinsFromVectors(config globals.Args, bm25Vectors [][]float32) VecBins {
+
+	metaData := config.DatasetMeta
+	if !validTokenPolicy(config.TokenPolicy) {
+		logrus.Fatalf("Unknown token policy %q, options are %s|%s|%s", config.TokenPolicy, TokenPolicyIDF,
+			TokenPolicyStopword, TokenPolicyFirst)
+	}
+
+	files := binsFilesOf(config)
+	var built builtBins
+	if config.Load {
+		built = loadBins(files, config)
+	} else {
+		built = buildBins(config)
 		if config.Save {
-			err = WriteCSV(config.DataName+"_unigram_DB.csv", DB)
-			Must(err)
-			logrus.Debugf("Saved DB to %s", config.DataName+"_unigram_DB.csv")
+			saveBins(files, config, built)
 		}
+	}
+	DB, keys, placement, layout, stats := built.db, built.keys, built.placement, built.layout, built.stats
 
+	// Entries hold the row of each doc in the corpus vectors, decoding maps it back through config.DocIDs
+	if config.DocIDs == nil {
+		var err error
+		config.DocIDs, err = LoadDocIDs(metaData.OriginalDir, metaData.Fields)
+		Must(err)
+	}
+	rowOf := make(map[string]uint32, len(config.DocIDs))
+	for row, docID := range config.DocIDs {
+		if docID != "" {
+			rowOf[docID] = uint32(row)
+		}
+	}
+
+	// Keyword entries start with the tag of the term in that slot
+	var tags []uint64
+	if config.KeywordPIR {
+		tags = make([]uint64, len(keys))
+		for i, key := range keys {
+			if key != "" {
+				tags[i] = keywordTag(key)
+			}
+		}
 	}
 
 	if config.DebugLevel >= 1 {
@@ -177,23 +433,40 @@ func MakeVecDb(config globals.Args) VecBins {
 	//pad := make([]float32, config.Dimensions)
 	maxRowSize := 0
 	redundancy := 0
+	maxScore := 0.0
 	for _, e := range DB {
 		if len(e) > maxRowSize {
 			maxRowSize = len(e)
 		}
+		for _, p := range e {
+			maxScore = max(maxScore, p.Score)
+		}
+	}
+
+	// Scores are stored quantised, scoreScale is what a quantised 1 is worth
+	scoreScale := 1.0
+	if maxScore > 0 {
+		scoreScale = maxScore / maxQuantScore
 	}
 
 	newDb := make([][][]float32, 0, len(DB))
+	scores := make([][]uint16, 0, len(DB))
+	docs := make([][]uint32, 0, len(DB))
 	for _, entry := range DB {
 		row := make([][]float32, 0, len(entry))
+		rowScores := make([]uint16, 0, len(entry))
+		rowDocs := make([]uint32, 0, len(entry))
 		// Add the vectors to the row
 		for j := 0; j < len(entry); j++ {
-			id, err := strconv.ParseUint(entry[j], 10, 32)
-			id64 := uint(id)
-			Must(err)
+			id, ok := rowOf[entry[j].DocID]
+			if !ok {
+				logrus.Fatalf("Doc %s of the bins is not in the corpus %s", entry[j].DocID, metaData.OriginalDir)
+			}
 			// This shouldn't do anything unless you're debugging!
-			id64 = id64 % config.DBSize
-			row = append(row, bm25Vectors[id64]) // shares the row slice; no copy
+			id = id % uint32(config.DBSize)
+			row = append(row, bm25Vectors[id]) // shares the row slice; no copy
+			rowScores = append(rowScores, quantiseScore(entry[j].Score, scoreScale))
+			rowDocs = append(rowDocs, id)
 		}
 		// Pad the row for all the missing vectors
 		//for len(row) < maxRowSize {
@@ -201,13 +474,15 @@ func MakeVecDb(config globals.Args) VecBins {
 		//	row = append(row, pad) // shared, no per-cell alloc
 		//}
 		newDb = append(newDb, row)
+		scores = append(scores, rowScores)
+		docs = append(docs, rowDocs)
 	}
 
 	if config.DebugLevel >= 1 {
-		wordsPerEntry := (uint64(config.Dimensions) * 4 * uint64(maxRowSize)) / 8
+		wordsPerEntry := uint64(rowWords(int(config.Dimensions)) * maxRowSize)
 		logrus.Debugf("Row layout: config.Dimensions=%d, maxRowSize=%d, wordsPerEntry=%d", config.Dimensions, maxRowSize, wordsPerEntry)
 
-		b := uint64(len(newDb)) * uint64(maxRowSize) * uint64(config.Dimensions) * 4
+		b := uint64(len(newDb)) * wordsPerEntry * 8
 		logrus.Debugf("New DB size: %.2f MiB (%d bytes)", float64(b)/(1<<20), b)
 
 		logrus.Debugf("Marco vectors: %.2f GiB", float64(config.DBSize*config.Dimensions*4)/(1<<30))
@@ -218,7 +493,8 @@ func MakeVecDb(config globals.Args) VecBins {
 	// PIR setup
 	// start := time.Now()
 
-	binPir := ProcessVecDB(config, uint(maxRowSize), newDb)
+	binPir := EncodeVecDB(config, uint(maxRowSize), newDb, scores, docs, tags)
+	binPir.ScoreScale = scoreScale
 	//end := time.Now()
 	//
 	//logrus.Infof("Preprocessing took %s", end.Sub(start))
@@ -233,18 +509,49 @@ func MakeVecDb(config globals.Args) VecBins {
 
 	}
 	binPir.Queries = queryMap
-	binPir.EnglishTokenAnalyzer = strictEnglishAnalyzer()
+	binPir.TokenAnalyzer = mustAnalyzer(metaData.Analyzer)
+	binPir.DChoice = max(config.DChoice, 1)
+	binPir.Ngram = config.Ngram
+	binPir.BatchSize = int(config.BatchSize)
+	binPir.TokenPolicy = config.TokenPolicy
+	binPir.Stats = stats
+	binPir.NonPrivateMode = !config.Private
+
+	// The most indices a single term can need
+	termCost := keywordChoices
+	if !config.KeywordPIR {
+		termCost = int(binPir.DChoice) * len(layout.rows(0))
+		if config.PlacementHint {
+			termCost = len(layout.rows(0))
+		}
+	}
+	if binPir.BatchSize > 0 && termCost > binPir.BatchSize {
+		logrus.Warnf("A single token needs %d indices but the batch only has %d, no token will ever be fetched",
+			termCost, binPir.BatchSize)
+	}
+	binPir.Layout = layout
+	if config.PlacementHint {
+		binPir.Placement = placement
+	}
 
 	return binPir
 
 }
 
-func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]float32) VecBins {
-	//DBEntrySize := config.Dimensions * 4 * maxRowSize // bytes per DB entry (maxRowSize vectors × config.Dimensions float32s)
-	DBSize := len(vectorsInBins)
+// ProcessVecDB packs the vectors, quantised scores and doc rows of every bin into a PIR entry (see entry.go) and sets
+// up a PIR over them. If tags is not nil, each non-empty entry is prefixed with its tag (keyword PIR).
+func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]float32, scores [][]uint16,
+	docs [][]uint32, tags []uint64) VecBins {
+	ret := EncodeVecDB(config, maxRowSize, vectorsInBins, scores, docs, tags)
+	ret.BatchSize = int(config.BatchSize)
+	ret.PIR = newBinsPIR(ret)
+	return ret
+}
 
-	// A single 'word' should be how many uint64s are required to re-make the entry (divide by 8 because uint64 is 8 bytes)
-	//wordsPerEntry := DBEntrySize / 8
+// EncodeVecDB is ProcessVecDB without the PIR.
+func EncodeVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]float32, scores [][]uint16,
+	docs [][]uint32, tags []uint64) VecBins {
+	DBSize := len(vectorsInBins)
 
 	// I think just DBsize is big enough but I might need to multiply by wordsPerEntry
 	rawDB := make([][]uint64, DBSize)
@@ -254,38 +561,10 @@ func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]floa
 
 	for i := 0; i < len(vectorsInBins); i++ {
 
-		vectorBytesArray := make([][]byte, 0, len(vectorsInBins[i]))
-
-		for j := 0; j < len(vectorsInBins[i]); j++ {
-			vector := vectorsInBins[i][j]
-			vectorBytes := make([]byte, config.Dimensions*4)
-			for k := 0; k < int(config.Dimensions) && k < len(vector); k++ {
-				binary.LittleEndian.PutUint32(vectorBytes[k*4:], math.Float32bits(vector[k]))
-			}
-			vectorBytesArray = append(vectorBytesArray, vectorBytes)
-		}
-
-		// Flatten the array of byte arrays into a single byte array
-		//TODO: this might be wrong....
-		entryBytes := make([]byte, 0, len(vectorBytesArray)*int(config.Dimensions)*4)
-		for _, vb := range vectorBytesArray {
-			// A byte array that is exactly the size of 1 entry.
-			entryBytes = append(entryBytes, vb...)
-		}
-
-		wordsPerEntry := (len(entryBytes) + 7) / 8 // ceil(bytes/8)
+		entry := encodeEntry(vectorsInBins[i], scores[i], docs[i], int(config.Dimensions))
 
-		entry := make([]uint64, wordsPerEntry)
-		for k := 0; k < wordsPerEntry; k++ {
-			off := k * 8
-			if off+8 <= len(entryBytes) {
-				entry[k] = binary.LittleEndian.Uint64(entryBytes[off : off+8])
-			} else {
-				// last partial word (only happens if total bytes not divisible by 8)
-				var tmp [8]byte
-				copy(tmp[:], entryBytes[off:])
-				entry[k] = binary.LittleEndian.Uint64(tmp[:])
-			}
+		if tags != nil && tags[i] != 0 {
+			entry = append([]uint64{tags[i]}, entry...)
 		}
 
 		// Copy into rawDB at the right offset
@@ -300,20 +579,10 @@ func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]floa
 	bar.Finish()
 
 	// TODO: Get average size instead of worst-case(?)
-	DBEntrySize := config.Dimensions * 4 * maxRowSize // bytes per DB entry (maxRowSize vectors × config.Dimensions float32s)
-	maxWordsPerEntry := (uint64(DBEntrySize) + 7) / 8
-
-	// Now that we have the rawDB, set up the PIR
-	// pir := pianopir.NewSimpleBatchPianoPIR(uint64(len(vectorsInBins)), uint64(DBEntrySize), uint64(DBEntrySize), 16, rawDB, 8)
-	pir := pianopir.NewSimpleBatchPianoPIR(
-		uint64(len(vectorsInBins)),
-		maxWordsPerEntry,
-		uint64(DBEntrySize),
-		16,
-		rawDB,
-		40,
-		16,
-	)
+	DBEntrySize := uint(rowWords(int(config.Dimensions))) * 8 * maxRowSize // bytes per DB entry (maxRowSize rows of vector + metadata)
+	if tags != nil {
+		DBEntrySize += 8 // room for the tag
+	}
 
 	//TODO: Remove this when not debugging
 	if len(rawDB) > 0 {
@@ -324,19 +593,16 @@ func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]floa
 		}
 	}
 
-	logrus.Info("PIR Ready for preprocessing")
-
-	// pir.Preprocessing()
-
 	ret := VecBins{
 		N:          len(vectorsInBins),
 		Dimensions: int(config.Dimensions),
 		EntrySize:  int(maxRowSize),
 		rawDB:      rawDB,
 
-		PIR:         pir,
 		DBTotalSize: uint64(len(vectorsInBins) * int(DBEntrySize)),
 		DBEntrySize: uint64(DBEntrySize),
+		Keyword:     tags != nil,
+		Rand:        rand.New(rand.NewSource(config.Seed)),
 	}
 
 	if config.DebugLevel >= 1 {
@@ -346,3 +612,141 @@ func ProcessVecDB(config globals.Args, maxRowSize uint, vectorsInBins [][][]floa
 	return ret
 
 }
+
+// newBinsPIR sets up a PIR over the bins whose batches fit v.BatchSize indices, so a padded query is one batch.
+func newBinsPIR(v VecBins) *pianopir.SimpleBatchPianoPIR {
+	maxWordsPerEntry := (v.DBEntrySize + 7) / 8
+	batchSize := max(v.BatchSize, pianopir.RealQueryPerPartition) // at least one partition
+
+	// Now that we have the rawDB, set up the PIR
+	// pir := pianopir.NewSimpleBatchPianoPIR(uint64(len(vectorsInBins)), uint64(DBEntrySize), uint64(DBEntrySize), 16, rawDB, 8)
+	pir := pianopir.NewSimpleBatchPianoPIR(
+		uint64(v.N),
+		maxWordsPerEntry,
+		v.DBEntrySize,
+		uint64(batchSize),
+		v.rawDB,
+		40,
+		16,
+	)
+
+	logrus.Info("PIR Ready for preprocessing")
+
+	// pir.Preprocessing()
+
+	return pir
+}
+
+// binsFiles are the CSVs the bins of a config are saved to and loaded from.
+type binsFiles struct {
+	db, placement, docFreq string
+}
+
+func binsFilesOf(config globals.Args) binsFiles {
+	binName, keywordName := "unigram", "keyword"
+	if config.Ngram > 1 { // Don't mix up DBs that were built with and without n-grams
+		binName = fmt.Sprintf("ngram%d", config.Ngram)
+		keywordName += "_" + binName
+	}
+	// Every word keeps its top config.K hits, so the bins of different k differ too
+	prefix := fmt.Sprintf("%s_%s_k%d", config.DataName, binName, config.K)
+	dbFile := prefix + "_DB.csv"
+	placementFile := prefix + "_placement.csv"
+	if config.KeywordPIR {
+		dbFile = fmt.Sprintf("%s_%s_k%d_DB.csv", config.DataName, keywordName, config.K)
+	}
+	docFreqFile := strings.TrimSuffix(dbFile, "_DB.csv") + "_docfreq.csv"
+	return binsFiles{dbFile, placementFile, docFreqFile}
+}
+
+// builtBins are the bins of a config as they were built or loaded, before they are encoded.
+type builtBins struct {
+	db        [][]Posting
+	keys      []string        // only set for keyword PIR
+	placement map[string]uint // only set for unigram bins
+	layout    binLayout       // only set for unigram bins
+	stats     termStats
+}
+
+// BuildBins builds the bins of config from the index and saves them, without loading the vectors or encoding the bins.
+// MakeVecDb with config.Load reads them back. Returns the files written, the DB first.
+func BuildBins(config globals.Args) []string {
+	files := binsFilesOf(config)
+	saveBins(files, config, buildBins(config))
+	if config.KeywordPIR {
+		return []string{files.db, files.docFreq}
+	}
+	return []string{files.db, files.placement, files.docFreq}
+}
+
+func buildBins(config globals.Args) builtBins {
+	metaData := config.DatasetMeta
+	if !validBinBuilder(config.BinBuilder) {
+		logrus.Fatalf("Unknown bin builder %q, options are %s|%s|%s", config.BinBuilder, BinBuilderPostings,
+			BinBuilderSearch, BinBuilderCompare)
+	}
+
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(metaData.IndexDir))
+	if err != nil {
+		logrus.Fatalf("Can't open the index of %s (build it with the index command): %v", metaData.Name, err)
+	}
+	defer reader.Close()
+	Must(CheckIndex(reader, metaData))
+
+	var built builtBins
+	var postings map[string][]Posting
+	postings, built.stats = MakeUnigramPostings(reader, metaData, config)
+	if config.KeywordPIR {
+		built.keys, built.db = MakeKeywordDB(postings, config.BinSize)
+	} else {
+		built.db, built.placement, built.layout = MakeUnigramDB(postings, config)
+	}
+	return built
+}
+
+func saveBins(files binsFiles, config globals.Args, built builtBins) {
+	var err error
+	if config.KeywordPIR {
+		err = WriteCSV(files.db, keywordCSV(built.keys, built.db))
+	} else {
+		err = WriteCSV(files.db, binsCSV(built.db))
+		Must(err)
+		err = WriteCSV(files.placement, placementCSV(built.placement))
+	}
+	Must(err)
+	err = WriteCSV(files.docFreq, docFreqCSV(built.stats))
+	Must(err)
+	logrus.Debugf("Saved DB to %s", files.db)
+}
+
+func loadBins(files binsFiles, config globals.Args) builtBins {
+	if _, err := os.Stat(files.db); errors.Is(err, os.ErrNotExist) {
+		logrus.Fatalf("There are no bins in %s, build them first with the build-bins command", files.db)
+	}
+
+	var built builtBins
+	// TODO: make this dynamic
+	rows, err := ReadCSV(files.db)
+	Must(err)
+	if config.KeywordPIR {
+		built.keys, built.db, err = keywordRows(rows)
+		Must(err)
+	} else {
+		built.db, err = binsRows(rows)
+		Must(err)
+		built.layout, err = layoutFromRows(config, len(built.db))
+		Must(err)
+		if config.PlacementHint {
+			rows, err := ReadCSV(files.placement)
+			Must(err)
+			built.placement, err = placementRows(rows)
+			Must(err)
+		}
+	}
+	rows, err = ReadCSV(files.docFreq)
+	Must(err)
+	built.stats, err = docFreqRows(rows)
+	Must(err)
+	logrus.Debugf("Loaded DB with %d items from %s", len(built.db), files.db)
+	return built
+}
@@ -0,0 +1,101 @@
+package bins
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func TestEncodedAnswersRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bins_10.answers")
+	want := globals.EncodedAnswers{
+		Dataset:    "test",
+		SearchType: "bins",
+		K:          10,
+		Dimensions: 4,
+		Answers: map[string]globals.Decodable{
+			"q1": DBentry{entry: [][]uint64{{1, 2, 3}, {4}}, tokens: []string{"privat", "search"}, scoreScale: 0.5},
+			"q2": DBentry{},
+		},
+	}
+	if err := globals.SaveEncodedAnswers(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := globals.LoadEncodedAnswers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkPoint", "test_bins_10.ckpt")
+	want := globals.Checkpoint{
+		Dataset:    "test",
+		SearchType: "bins",
+		K:          10,
+		Seed:       7,
+		QIDs:       []string{"q1", "q2", "q3"},
+		Next:       2,
+		Answers: map[string]globals.Decodable{
+			"q1": DBentry{entry: [][]uint64{{1, 2}}, tokens: []string{"privat"}, scoreScale: 0.5},
+			"q2": DBentry{},
+		},
+		Mismatches: 1,
+		PIR:        []byte{1, 2, 3},
+	}
+	if err := globals.SaveCheckpoint(path, want); err != nil {
+		t.Fatal(err)
+	}
+	// Saving again replaces it
+	want.Next = 3
+	if err := globals.SaveCheckpoint(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := globals.LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// It holds the keys of the PIR client
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("checkpoint is %v, want readable by its owner only", info.Mode())
+	}
+	if leftovers, _ := filepath.Glob(path + ".tmp*"); len(leftovers) != 0 {
+		t.Errorf("left temp files %v", leftovers)
+	}
+}
+
+func TestCollidingTermsShareScore(t *testing.T) {
+	// privat and search are both placed in bin 0 and both hit doc 1
+	postings := map[string][]Posting{"privat": {{"1", 2}}, "search": {{"1", 5}, {"2", 1}}}
+	binOf := map[string]uint{"privat": 0, "search": 0}
+	ranked := rankBin(fillBins([]string{"privat", "search"}, postings, binOf, 1)[0])
+
+	vectors := make([][]float32, len(ranked))
+	scores := make([]uint16, len(ranked))
+	docs := make([]uint32, len(ranked))
+	for i, p := range ranked {
+		id, _ := strconv.Atoi(p.DocID)
+		vectors[i] = []float32{float32(id), 0}
+		scores[i] = quantiseScore(p.Score, 1)
+		docs[i] = uint32(id)
+	}
+	d := DBentry{entry: [][]uint64{encodeEntry(vectors, scores, docs, 2)}, tokens: []string{"privat"}, scoreScale: 1}
+
+	// privat is credited with the score search gave doc 1, and with doc 2 that only search hits
+	want := []Candidate{{"1", 1, 5, []float32{1, 0}}, {"2", 2, 1, []float32{2, 0}}}
+	if got := d.Candidates(globals.Args{Dimensions: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package bins
+
+// Analyzers. A term is made in three places: when the index is built, when the corpus is scanned for the vocab (the
+// bin keys) and when a query is turned into bin keys. All three run the same analyzer, picked by name per dataset (the
+// "analyzer" field of the dataset registry). Everything after that works on the analysed terms as they are: the BM25
+// searches that fill the bins are term and phrase queries, so a stemmed vocab word is never analysed a second time.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/blugelabs/bluge/analysis"
+	"github.com/blugelabs/bluge/analysis/char"
+	"github.com/blugelabs/bluge/analysis/lang/cjk"
+	"github.com/blugelabs/bluge/analysis/lang/en"
+	"github.com/blugelabs/bluge/analysis/token"
+	"github.com/blugelabs/bluge/analysis/tokenizer"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	AnalyzerStrictEnglish = "strict-english" // letters only, English stopwords dropped, stemmed (the default)
+	AnalyzerEnglishNoStem = "english-nostem" // strict-english without the stemmer
+	AnalyzerMultilingual  = "multilingual"   // Unicode words, NFKC, CJK bigrams, no stopwords or stemming
+	AnalyzerCharNgram     = "char-ngram"     // 3 to 5 letter n-grams of every lowercased word
+
+	DefaultAnalyzer = AnalyzerStrictEnglish
+)
+
+var analyzers = map[string]func() *analysis.Analyzer{
+	AnalyzerStrictEnglish: strictEnglishAnalyzer,
+	AnalyzerEnglishNoStem: englishNoStemAnalyzer,
+	AnalyzerMultilingual:  multilingualAnalyzer,
+	AnalyzerCharNgram:     charNgramAnalyzer,
+}
+
+// NewAnalyzer returns a fresh analyzer of the given name, "" being DefaultAnalyzer.
+func NewAnalyzer(name string) (*analysis.Analyzer, error) {
+	newAnalyzer, ok := analyzers[analyzerName(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer %q, options are %s", name, strings.Join(AnalyzerNames(), "|"))
+	}
+	return newAnalyzer(), nil
+}
+
+// AnalyzerNames lists the analyzers NewAnalyzer knows.
+func AnalyzerNames() []string {
+	names := make([]string, 0, len(analyzers))
+	for name := range analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func analyzerName(name string) string {
+	if name == "" {
+		return DefaultAnalyzer
+	}
+	return name
+}
+
+// mustAnalyzer is NewAnalyzer for names that were already checked at startup.
+func mustAnalyzer(name string) *analysis.Analyzer {
+	analyzer, err := NewAnalyzer(name)
+	Must(err)
+	return analyzer
+}
+
+func strictEnglishAnalyzer() *analysis.Analyzer {
+	return &analysis.Analyzer{
+		// Optional: normalize punctuation BEFORE tokenizing (e.g., turn periods/commas into spaces)
+		CharFilters: []analysis.CharFilter{
+			char.NewRegexpCharFilter(regexp.MustCompile(`[.,]+`), []byte(" ")),
+		},
+		// Critical: letters-only tokenizer (drops digits/punct)
+		Tokenizer: tokenizer.NewLetterTokenizer(),
+		TokenFilters: []analysis.TokenFilter{
+			en.NewPossessiveFilter(),
+			token.NewLowerCaseFilter(),
+			token.NewStopTokensFilter(en.StopWords()),
+			en.StemmerFilter(),
+			token.NewLengthFilter(2, 40), // tune min/max token length
+		},
+	}
+}
+
+func englishNoStemAnalyzer() *analysis.Analyzer {
+	return &analysis.Analyzer{
+		CharFilters: []analysis.CharFilter{
+			char.NewRegexpCharFilter(regexp.MustCompile(`[.,]+`), []byte(" ")),
+		},
+		Tokenizer: tokenizer.NewLetterTokenizer(),
+		TokenFilters: []analysis.TokenFilter{
+			en.NewPossessiveFilter(),
+			token.NewLowerCaseFilter(),
+			token.NewStopTokensFilter(en.StopWords()),
+			token.NewLengthFilter(2, 40),
+		},
+	}
+}
+
+func multilingualAnalyzer() *analysis.Analyzer {
+	return &analysis.Analyzer{
+		Tokenizer: tokenizer.NewUnicodeTokenizer(),
+		TokenFilters: []analysis.TokenFilter{
+			token.NewUnicodeNormalizeFilter(norm.NFKC),
+			cjk.NewWidthFilter(),
+			token.NewLowerCaseFilter(),
+			cjk.NewBigramFilter(false),
+			token.NewLengthFilter(1, 40), // a single CJK character is a word
+		},
+	}
+}
+
+func charNgramAnalyzer() *analysis.Analyzer {
+	return &analysis.Analyzer{
+		Tokenizer: tokenizer.NewLetterTokenizer(),
+		TokenFilters: []analysis.TokenFilter{
+			token.NewLowerCaseFilter(),
+			token.NewNgramFilter(3, 5),
+		},
+	}
+}
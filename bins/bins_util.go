@@ -3,42 +3,20 @@ package bins
 import (
 	"bufio"
 	"context"
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
-	"math"
 	"os"
-	"strconv"
-	"strings"
 
 	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/analysis"
+	"github.com/dkblackley/bins-go/eval"
 	"github.com/dkblackley/bins-go/globals"
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
 )
 
-// Used to convert beir data into formate for go bm25
-//
-// For scifact doc ID is just an integer, like: "40584205" or "10608397", sometimes it's a smaller number though, like:
-// "3845894" or probably even "1"
-// For TREC-COVID its strings like "1hvihwkz" or "3jolt83r". Bodies are just sentences of text.
-//func index_stuff() {
-//	// 1) SCIFACT
-//	LoadBeirJSONL("/home/yelnat/Nextcloud/10TB-STHDD/datasets/scifact/corpus.jsonl", "index_scifact")
-//	logrus.SetLevel(logrus.InfoLevel)
-//	// 2) TREC-COVID
-//	LoadBeirJSONL("/home/yelnat/Nextcloud/10TB-STHDD/datasets/trec-covid/corpus.jsonl", "index_trec_covid")
-//
-//	// 3) MSMARCO passage
-//	// loadMSMARCO("/home/yelnat/Nextcloud/10TB-STHDD/datasets/msmarco/collection.tsv", "index_msmarco")
-//
-//	log.Println("✅  All indices built.")
-//}
-
 // Takes in a mapping from QID to DOCID and loads the query text and document text. Then Re-ranks all the docIDs based
 // Upon the BM25 search. Returns a mapping with only the top-k (from config) documents
 func BasicReRank(results map[string][]string, config globals.Args) map[string][]string {
@@ -56,6 +34,7 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 	}
 
 	metaData := config.DatasetMeta
+	analyzer := mustAnalyzer(metaData.Analyzer)
 
 	err := FilterJSONLByIDs(metaData.OriginalDir, config.SearchType+"temp_doc.jsonl", docIDs)
 	Must(err)
@@ -63,7 +42,8 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 	Must(err)
 
 	// NEW: build a real Bluge index directory from temp_doc.jsonl
-	err = BuildBlugeIndexFromJSONL(config.SearchType+"temp_doc.jsonl", config.SearchType+"temp_doc")
+	err = BuildBlugeIndexFromJSONL(config.SearchType+"temp_doc.jsonl", config.SearchType+"temp_doc", metaData.Fields,
+		analyzer)
 	Must(err)
 
 	// Now do BLUGE on the remaining items
@@ -86,16 +66,14 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 		}
 	}(reader)
 
-	var sumRR float64
-
 	if len(qs) <= 0 {
 		log.Fatal("No results found")
 	}
 	for _, q := range qs {
 
 		// simple: match Query text against both title and body
-		matchTitle := bluge.NewMatchQuery(q.Text).SetField("title")
-		matchBody := bluge.NewMatchQuery(q.Text).SetField("body")
+		matchTitle := bluge.NewMatchQuery(q.Text).SetField("title").SetAnalyzer(analyzer)
+		matchBody := bluge.NewMatchQuery(q.Text).SetField("body").SetAnalyzer(analyzer)
 		boolean := bluge.NewBooleanQuery().
 			AddShould(matchTitle).
 			AddShould(matchBody)
@@ -105,7 +83,6 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 
 		Must(err)
 
-		rr := 0.0
 		for rank := 1; rank <= int(config.K); rank++ {
 			match, err := it.Next()
 			if err != nil {
@@ -127,14 +104,8 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 			Must(err)
 
 			new_results[q.ID] = append(new_results[q.ID], docID)
-
-			if rels[q.ID][docID] > 0 {
-				rr = 1.0 / float64(rank)
-				break
-			}
 		}
 
-		sumRR += rr
 		err = bar.Add(1)
 		if err != nil {
 			log.Fatal(err)
@@ -142,7 +113,9 @@ func BasicReRank(results map[string][]string, config globals.Args) map[string][]
 
 	}
 
-	logrus.Infof("MRR (post BM25 search): %f", sumRR/float64(len(rels)))
+	report := eval.Evaluate(rels, new_results, []int{int(config.K)})
+	logrus.Infof("MRR@%d (post BM25 search): %f over %d queries", config.K, report.Mean[fmt.Sprintf("mrr@%d", config.K)],
+		len(report.PerQuery))
 
 	// old temp jsonl cleanup is fine
 	Must(os.Remove(config.SearchType + "temp_doc.jsonl"))
@@ -163,6 +136,7 @@ func FilterJSONLByIDs(inputPath, outputPath string, docIDs []string) error {
 	for _, id := range docIDs {
 		idSet[id] = struct{}{}
 	}
+	malformed := 0
 
 	inFile, err := os.Open(inputPath)
 	if err != nil {
@@ -187,6 +161,7 @@ func FilterJSONLByIDs(inputPath, outputPath string, docIDs []string) error {
 	}(outFile)
 
 	scanner := bufio.NewScanner(inFile)
+	scanner.Buffer(make([]byte, 1024), 16*1024*1024)
 	writer := bufio.NewWriter(outFile)
 	defer func(writer *bufio.Writer) {
 		err := writer.Flush()
@@ -198,25 +173,13 @@ func FilterJSONLByIDs(inputPath, outputPath string, docIDs []string) error {
 	for scanner.Scan() {
 		line := append([]byte(nil), scanner.Bytes()...)
 
-		var obj struct {
-			ID      string `json:"_id"`
-			AltID   string `json:"id"`
-			QueryID string `json:"query_id"`
-		}
-
+		var obj map[string]json.RawMessage
 		if err := json.Unmarshal(line, &obj); err != nil {
-			logrus.Errorf("Error unmarshalling JSON: %v", err)
-			return err // I think this might be causing issues
+			malformed++
+			continue
 		}
 
-		id := obj.ID
-		if id == "" {
-			if obj.AltID != "" {
-				id = obj.AltID
-			} else {
-				id = obj.QueryID
-			}
-		}
+		id := firstField(obj, filterIDFields)
 		if id == "" {
 			continue
 		}
@@ -231,98 +194,16 @@ func FilterJSONLByIDs(inputPath, outputPath string, docIDs []string) error {
 		}
 	}
 
+	if malformed > 0 {
+		logrus.Warnf("Skipped %d malformed lines of %s", malformed, inputPath)
+	}
 	return scanner.Err()
 }
 
-func BuildBlugeIndexFromJSONL(jsonlPath, indexDir string) error {
-	// Start fresh (important if you re-run)
-	if err := os.RemoveAll(indexDir); err != nil {
-		return err
-	}
-	if err := os.MkdirAll(indexDir, 0o755); err != nil {
-		return err
-	}
-
-	w, err := bluge.OpenWriter(bluge.DefaultConfig(indexDir))
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Open(jsonlPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
-	// JSONL lines can be long; bump scanner limit.
-	buf := make([]byte, 0, 1024*1024)
-	sc.Buffer(buf, 16*1024*1024) // 16MB max line
-
-	batch := bluge.NewBatch()
-	const flushEvery = 2000
-	batchCount := 0
-	totalInserted := 0
-
-	for sc.Scan() {
-		var d beirDoc
-		if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
-			logrus.Tracef("json unmarshal failed: %w", err)
-		}
-
-		id := strings.Clone(d.ID)
-		if id == "" {
-			continue
-		}
-
-		title := strings.Clone(d.Title)
-		text := strings.Clone(d.Text)
-
-		doc := bluge.NewDocument(id)
-		if title != "" {
-			doc.AddField(bluge.NewTextField("title", title))
-		}
-		if text != "" {
-			doc.AddField(bluge.NewTextField("body", text))
-		}
-		// store _id so your VisitStoredFields logic still works
-		doc.AddField(bluge.NewKeywordField("_id", id).StoreValue())
-
-		batch.Insert(doc)
-		batchCount++
-		totalInserted++
-
-		if batchCount >= flushEvery {
-			if err := w.Batch(batch); err != nil {
-				return err
-			}
-			batch = bluge.NewBatch()
-			batchCount = 0
-		}
-	}
-
-	if err := sc.Err(); err != nil {
-		return err
-	}
-
-	// Flush remainder
-	if batchCount > 0 {
-		if err := w.Batch(batch); err != nil {
-			return err
-		}
-	}
-
-	// Ensure we actually created an index snapshot
-	if totalInserted == 0 {
-		return fmt.Errorf("no documents indexed (temp jsonl produced zero parseable docs?)")
-	}
-
-	// Close writer and surface errors (snapshot persistence happens here as well)
-	if err := w.Close(); err != nil {
-		return err
-	}
-
-	return nil
+// BuildBlugeIndexFromJSONL indexes a (filtered) corpus with analyzer, for re-ranking.
+func BuildBlugeIndexFromJSONL(jsonlPath, indexDir string, fields globals.CorpusFields, analyzer *analysis.Analyzer) error {
+	_, err := writeIndex(jsonlPath, indexDir, fields, analyzer)
+	return err
 }
 
 // ----------------- evaluation ----------------------------------------------
@@ -499,97 +380,3 @@ func WriteCSV(path string, data [][]string) error {
 	}
 	return w.Error()
 }
-
-func MakeLookup(meta globals.DatasetMetadata, dbsize, dimensions int) map[[32]byte]string {
-
-	IDLookup := make(map[[32]byte]string)
-	vectors, err := globals.LoadFloat32MatrixFromNpy(meta.Vectors.CorpusVec, dbsize, dimensions)
-
-	bar := progressbar.NewOptions64(
-		int64(len(vectors)),
-		progressbar.OptionSetDescription("Making map"),
-		progressbar.OptionShowElapsedTimeOnFinish(),
-	)
-	Must(err)
-	for i := 0; i < len(vectors); i++ {
-		ID := HashFloat32s(vectors[i])
-		IDLookup[ID] = strconv.Itoa(i)
-		bar.Add(1)
-	}
-
-	bar.Finish()
-
-	return IDLookup
-}
-
-func DecodeEntryToVectors(entry []uint64, Dim int) ([][]float32, error) {
-	if Dim <= 0 {
-		return nil, errors.New("DecodeEntryToVectors: Dim must be > 0")
-	}
-	if len(entry) == 0 {
-		return nil, errors.New("DecodeEntryToVectors: empty entry")
-	}
-
-	wordsPerVec := (Dim + 1) / 2 // 2 float32 per uint64
-	if len(entry)%wordsPerVec != 0 {
-		return nil, fmt.Errorf(
-			"decodeEntryToVectors: len(entry)=%d not divisible by wordsPerVec=%d (Dim=%d). "+
-				"Wrong Dim or PIR entry sizing mismatch",
-			len(entry), wordsPerVec, Dim,
-		)
-	}
-
-	maxRowSize := len(entry) / wordsPerVec
-
-	// Trim trailing *all-zero vectors* (not trailing zero words)
-	actualRows := maxRowSize
-	for actualRows > 0 {
-		start := (actualRows - 1) * wordsPerVec
-		end := start + wordsPerVec
-
-		allZero := true
-		for _, w := range entry[start:end] {
-			if w != 0 {
-				allZero = false
-				break
-			}
-		}
-		if !allZero {
-			break
-		}
-		actualRows--
-	}
-
-	// Decode only the non-padding vectors
-	out := make([][]float32, actualRows)
-	pos := 0
-	for r := 0; r < actualRows; r++ {
-		row := make([]float32, Dim)
-		d := 0
-		for d < Dim {
-			w := entry[pos]
-			pos++
-
-			row[d] = math.Float32frombits(uint32(w))
-			d++
-			if d < Dim {
-				row[d] = math.Float32frombits(uint32(w >> 32))
-				d++
-			}
-		}
-		out[r] = row
-	}
-
-	return out, nil
-}
-
-func HashFloat32s(xs []float32) [32]byte {
-	buf := make([]byte, 4*len(xs))
-	for i, f := range xs {
-		bits := math.Float32bits(f)
-		binary.LittleEndian.PutUint32(buf[i*4:], bits)
-	}
-
-	sum := sha256.Sum256(buf)
-	return sum
-}
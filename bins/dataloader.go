@@ -9,10 +9,11 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/blugelabs/bluge"
+	"github.com/dkblackley/bins-go/eval"
+	"github.com/dkblackley/bins-go/globals"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,112 +28,177 @@ func Must(err error) {
 // ---------- simple BEIR JSONL loader ---------------------------------------
 
 type beirDoc struct {
-	ID    string `json:"_id"`
-	Title string `json:"title"`
-	Text  string `json:"text"`
-	// These fields should always be empty, I just include it to avoid decoding errors
-	Abstract string `json:"abstract"` // used by SciFact
-	Metadata string `json:"metadata"`
+	ID    string
+	Row   int // the line of the corpus it is on (blank lines aside), which is its row in the corpus vectors
+	Title string
+	Text  string
+	// Whatever the "metadata" field of the line holds (an object in NFCorpus, FiQA...), nil if there isn't one
+	Metadata json.RawMessage
 }
 
-//func LoadBeirJSONL(path, indexDir string) {
-//	f, err := os.Open(path)
-//	Must(err)
-//	defer f.Close()
-//
-//	var counter = 0
-//
-//	cfg := bluge.DefaultConfig(indexDir)
-//	w, err := bluge.OpenWriter(cfg)
-//	Must(err)
-//	defer w.Close()
-//
-//	bar := progressbar.Default(-1, "index "+indexDir) // unknown total
-//
-//	sc := bufio.NewScanner(f)
-//	sc.Buffer(make([]byte, 1024*1024), 10*1024*1024) // 1 MiB buf, 10 MiB max
-//
-//	for sc.Scan() {
-//		bar.Add64(int64(len(sc.Bytes()) + 1)) // +1 for '\n'
-//
-//		// use a Decoder so we can catch unknown fields
-//		raw := sc.Bytes()
-//		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
-//		dec.DisallowUnknownFields()
-//
-//		var d beirDoc
-//		if err := dec.Decode(&d); err != nil {
-//			// if it's an unknown‐field error, log it and continue
-//			if strings.HasPrefix(err.Error(), "json: unknown field") {
-//				logrus.Tracef("⚠️  unknown JSON field in line: %v", err)
-//				logrus.Tracef("Raw JSON line: %s", raw)
-//			}
-//		}
-//
-//		// now index as before
-//		doc := bluge.NewDocument(d.ID)
-//		doc.AddField(bluge.NewTextField("title", d.Title))
-//
-//		body := d.Text
-//		if body == "" {
-//			body = d.Abstract
-//		}
-//		doc.AddField(bluge.NewTextField("body", body))
-//		doc.AddField(bluge.NewKeywordField("dataset", indexDir))
-//
-//		Must(w.Insert(doc))
-//		counter++
-//	}
-//	if err := sc.Err(); err != nil {
-//		log.Fatal(err)
-//	}
-//	bar.Finish()
-//
-//	logrus.Debugf("Total documents: %d", counter)
-//}
-
-type qrels map[string]map[string]int
-
-func LoadCorpus(path string) ([]beirDoc, error) {
-	f, err := os.Open(path)
-	Must(err)
-	defer f.Close()
+// CorpusReport counts what LoadCorpus did with every line of the corpus.
+type CorpusReport struct {
+	Lines      int
+	Loaded     int
+	Malformed  int // not a JSON object
+	MissingID  int
+	Empty      int // no title and no text
+	Duplicates int // ID seen on an earlier line, the first one is kept
+}
 
-	var counter = 0
+func (r CorpusReport) String() string {
+	return fmt.Sprintf("%d lines: %d docs loaded, skipped %d malformed, %d without an ID, %d empty and %d duplicates",
+		r.Lines, r.Loaded, r.Malformed, r.MissingID, r.Empty, r.Duplicates)
+}
+
+var (
+	beirIDFields    = []string{"_id", "id", "doc_id", "docid"}
+	filterIDFields  = []string{"_id", "id", "doc_id", "docid", "query_id"}
+	beirTitleFields = []string{"title"}
+	beirTextFields  = []string{"text", "abstract"}
+)
+
+// parseBeirDoc reads a corpus line of any schema: the ID from the usual ID fields (string or number), the title from
+// fields.Title (or the URL if there is no title), the text from every non-empty field of fields.Text joined together.
+// Fields can hold a string, a number or a list of strings. Everything else in the line is ignored.
+func parseBeirDoc(line []byte, fields globals.CorpusFields) (beirDoc, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return beirDoc{}, err
+	}
+
+	titleFields, textFields := fields.Title, fields.Text
+	if len(titleFields) == 0 {
+		titleFields = beirTitleFields
+	}
+	if len(textFields) == 0 {
+		textFields = beirTextFields
+	}
+
+	d := beirDoc{
+		ID:       firstField(raw, beirIDFields),
+		Title:    joinFields(raw, titleFields),
+		Text:     joinFields(raw, textFields),
+		Metadata: raw["metadata"],
+	}
+	if d.Title == "" {
+		d.Title = firstField(raw, []string{"url"})
+	}
+	return d, nil
+}
+
+// fieldText is the text of a JSON value: strings as they are, numbers as written, lists of them joined by spaces.
+func fieldText(value json.RawMessage) string {
+	var str string
+	if err := json.Unmarshal(value, &str); err == nil {
+		return strings.TrimSpace(str)
+	}
+	var num json.Number
+	if err := json.Unmarshal(value, &num); err == nil {
+		return num.String()
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err == nil {
+		parts := make([]string, 0, len(list))
+		for _, v := range list {
+			if t := fieldText(v); t != "" {
+				parts = append(parts, t)
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	return ""
+}
+
+func firstField(raw map[string]json.RawMessage, names []string) string {
+	for _, name := range names {
+		if t := fieldText(raw[name]); t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+func joinFields(raw map[string]json.RawMessage, names []string) string {
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		if t := fieldText(raw[name]); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+type qrels = eval.Qrels
 
+// LoadCorpus reads a BEIR style JSONL corpus, see parseBeirDoc. Lines that can't be used are skipped and counted in the
+// report instead of turning into empty docs.
+func LoadCorpus(path string, fields globals.CorpusFields) ([]beirDoc, CorpusReport, error) {
 	var ds []beirDoc
+	report, err := StreamCorpus(path, fields, func(d beirDoc) {
+		ds = append(ds, d)
+	})
+	return ds, report, err
+}
+
+// StreamCorpus is LoadCorpus without holding the corpus: every doc is handed to fn as soon as it is read. Only the IDs
+// are kept, to skip duplicates.
+func StreamCorpus(path string, fields globals.CorpusFields, fn func(beirDoc)) (CorpusReport, error) {
+	var report CorpusReport
+
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]struct{})
 	sc := bufio.NewScanner(f)
 
 	sc.Buffer(make([]byte, 1024), 10*1024*1024) // max 10 mib, should be fine (I hope)
 	for sc.Scan() {
-		raw := sc.Bytes()
-		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
-		dec.DisallowUnknownFields()
-
-		var d beirDoc
-		if err := dec.Decode(&d); err != nil {
-			// if it's an unknown‐field error, log it and continue
-			if strings.HasPrefix(err.Error(), "json: unknown field") {
-				logrus.Errorf("⚠️  unknown JSON field in line: %v", err)
-				logrus.Errorf("Raw JSON line: %s", raw)
-			}
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
 		}
+		report.Lines++
 
-		body := d.Text
-		if body == "" {
-			body = d.Abstract
+		d, err := parseBeirDoc(sc.Bytes(), fields)
+		switch {
+		case err != nil:
+			report.Malformed++
+			logrus.Tracef("Corpus line %d: %v", report.Lines, err)
+			continue
+		case d.ID == "":
+			report.MissingID++
+			continue
+		case d.Title == "" && d.Text == "":
+			report.Empty++
+			continue
 		}
-
-		document := beirDoc{
-			ID:    d.ID,
-			Title: d.Title,
-			Text:  body,
+		if _, ok := seen[d.ID]; ok {
+			report.Duplicates++
+			continue
 		}
+		seen[d.ID] = struct{}{}
 
-		ds = append(ds, document)
-		counter++
+		d.Row = report.Lines - 1
+		fn(d)
+		report.Loaded++
 	}
-	return ds, sc.Err()
+	return report, sc.Err()
+}
+
+// LoadDocIDs reads the doc ID of every row of the corpus vectors, which hold one vector per corpus line in order (see
+// beirDoc.Row). Rows of lines that aren't docs are "".
+func LoadDocIDs(path string, fields globals.CorpusFields) ([]string, error) {
+	var ids []string
+	_, err := StreamCorpus(path, fields, func(d beirDoc) {
+		for len(ids) < d.Row {
+			ids = append(ids, "")
+		}
+		ids = append(ids, d.ID)
+	})
+	return ids, err
 }
 
 type Query struct {
@@ -187,31 +253,9 @@ func LoadQueries(query_path string) ([]Query, error) {
 	return qs, sc.Err()
 }
 
+// loadQrels reads graded qrels, see eval.LoadQrels.
 func loadQrels(path string) (qrels, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	rel := make(qrels)
-	sc := bufio.NewScanner(f)
-	for sc.Scan() {
-		line := strings.Fields(sc.Text())
-		if len(line) < 3 {
-			continue
-		}
-		qid, docid, score := line[0], line[1], line[2]
-		v, _ := strconv.Atoi(score)
-		if v <= 0 {
-			continue
-		}
-		if _, ok := rel[qid]; !ok {
-			rel[qid] = make(map[string]int)
-		}
-		rel[qid][docid] = v
-	}
-	return rel, sc.Err()
+	return eval.LoadQrels(path)
 }
 
 // StringsToUint64Grid encodes []string -> [][]uint64. Strings are easy to make into bytes, but awkward to handle as
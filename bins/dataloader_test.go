@@ -0,0 +1,67 @@
+package bins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func TestLoadCorpus(t *testing.T) {
+	corpus := `{"_id": "d1", "title": "Title", "text": "body", "metadata": {"url": "x", "authors": ["a"]}}
+{"id": 2, "abstract": "only an abstract", "metadata": "plain string"}
+{"_id": "d3", "url": "https://example.org/d3"}
+not json at all
+{"title": "no id"}
+{"_id": "d5", "metadata": {}}
+{"_id": "d1", "text": "duplicate"}
+
+{"doc_id": "d6", "headline": "custom", "paragraphs": ["one", "two"]}
+`
+	path := filepath.Join(t.TempDir(), "corpus.jsonl")
+	if err := os.WriteFile(path, []byte(corpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, report, err := LoadCorpus(path, globals.CorpusFields{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CorpusReport{Lines: 8, Loaded: 3, Malformed: 1, MissingID: 1, Empty: 2, Duplicates: 1}
+	if report != want {
+		t.Errorf("got report %+v, want %+v", report, want)
+	}
+	wantDocs := []beirDoc{
+		{ID: "d1", Title: "Title", Text: "body"},
+		{ID: "2", Text: "only an abstract"},
+		{ID: "d3", Title: "https://example.org/d3"},
+	}
+	for i, d := range docs {
+		if i >= len(wantDocs) || d.ID != wantDocs[i].ID || d.Title != wantDocs[i].Title || d.Text != wantDocs[i].Text {
+			t.Fatalf("got docs %+v, want %+v", docs, wantDocs)
+		}
+	}
+	if string(docs[0].Metadata) != `{"url": "x", "authors": ["a"]}` {
+		t.Errorf("metadata object not kept, got %s", docs[0].Metadata)
+	}
+
+	// Every line is a row of the vectors, whether it is a doc or not
+	ids, err := LoadDocIDs(path, globals.CorpusFields{Title: []string{"headline"}, Text: []string{"paragraphs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 8 || ids[7] != "d6" || ids[0] != "" {
+		t.Errorf("got doc IDs %q, want d6 in row 7 only", ids)
+	}
+
+	// With the right fields the custom line loads
+	docs, report, err = LoadCorpus(path, globals.CorpusFields{Title: []string{"headline"}, Text: []string{"paragraphs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := docs[len(docs)-1]
+	if last.ID != "d6" || last.Title != "custom" || last.Text != "one two" {
+		t.Errorf("got %+v", last)
+	}
+}
@@ -0,0 +1,108 @@
+package bins
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Layout of a bin entry. Every doc in the bin takes one row: its vector, two float32s per uint64 (an odd last
+// dimension is padded to a whole word), followed by one metadata word:
+//
+//	bits 0-15:  the doc's BM25 score for the bin, quantised to 1..maxQuantScore
+//	bits 32-63: the doc's row in the corpus vectors, decoding maps it back to its ID (see globals.Args.DocID)
+//
+// The score is never quantised to 0, so a real row is never all zeros and the padding PIR adds to short entries can be
+// trimmed off. Keyword PIR entries have one more word in front holding the key tag, KeywordQuery strips it.
+
+const (
+	scoreBits     = 16
+	scoreMask     = 1<<scoreBits - 1
+	maxQuantScore = scoreMask
+	docShift      = 32
+)
+
+// BinRow is one decoded doc from a bin entry.
+type BinRow struct {
+	Vector []float32
+	Score  uint16 // quantised BM25 score, multiply by the DB's score scale to get it back
+	Doc    uint32 // row of the doc in the corpus vectors
+}
+
+func vectorWords(dim int) int {
+	return (dim + 1) / 2
+}
+
+// rowWords is the number of uint64s a single doc takes up in an entry.
+func rowWords(dim int) int {
+	return vectorWords(dim) + 1
+}
+
+// quantiseScore maps score onto 1..maxQuantScore, where scale is the score that a quantised 1 stands for.
+func quantiseScore(score float64, scale float64) uint16 {
+	q := math.Round(score / scale)
+	return uint16(min(max(q, 1), maxQuantScore))
+}
+
+// encodeEntry packs the vectors, quantised scores and doc ordinals of one bin into a PIR entry.
+func encodeEntry(vectors [][]float32, scores []uint16, docs []uint32, dim int) []uint64 {
+	entry := make([]uint64, 0, len(vectors)*rowWords(dim))
+
+	for i, vector := range vectors {
+		for d := 0; d < dim; d += 2 {
+			w := uint64(math.Float32bits(vector[d]))
+			if d+1 < dim {
+				w |= uint64(math.Float32bits(vector[d+1])) << 32
+			}
+			entry = append(entry, w)
+		}
+		entry = append(entry, uint64(scores[i])&scoreMask|uint64(docs[i])<<docShift)
+	}
+
+	return entry
+}
+
+// DecodeEntryToRows unpacks a PIR entry back into its docs, dropping the all zero rows PIR pads short entries with.
+func DecodeEntryToRows(entry []uint64, Dim int) ([]BinRow, error) {
+	if Dim <= 0 {
+		return nil, errors.New("DecodeEntryToRows: Dim must be > 0")
+	}
+	if len(entry) == 0 {
+		return nil, errors.New("DecodeEntryToRows: empty entry")
+	}
+
+	wordsPerRow := rowWords(Dim)
+	if len(entry)%wordsPerRow != 0 {
+		return nil, fmt.Errorf(
+			"DecodeEntryToRows: len(entry)=%d not divisible by wordsPerRow=%d (Dim=%d). "+
+				"Wrong Dim or PIR entry sizing mismatch",
+			len(entry), wordsPerRow, Dim,
+		)
+	}
+
+	out := make([]BinRow, 0, len(entry)/wordsPerRow)
+	for start := 0; start < len(entry); start += wordsPerRow {
+		meta := entry[start+wordsPerRow-1]
+		if meta&scoreMask == 0 {
+			// Padding, and every row after this one is padding too
+			break
+		}
+
+		vector := make([]float32, Dim)
+		for d := 0; d < Dim; d++ {
+			w := entry[start+d/2]
+			if d%2 == 1 {
+				w >>= 32
+			}
+			vector[d] = math.Float32frombits(uint32(w))
+		}
+
+		out = append(out, BinRow{
+			Vector: vector,
+			Score:  uint16(meta & scoreMask),
+			Doc:    uint32(meta >> docShift),
+		})
+	}
+
+	return out, nil
+}
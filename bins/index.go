@@ -0,0 +1,214 @@
+package bins
+
+// The bluge index the bins are searched from. BuildIndex writes it from the BEIR corpus with the dataset's analyzer
+// (see analyzers.go), the one the vocab is scanned with, so every vocab word is a term of the index. It also leaves an
+// IndexMetadataFile next to the segments, which BuildBins checks the index against with CheckIndex: an index of another
+// corpus, or one analysed differently, is caught before any bins are built from it.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/analysis"
+	"github.com/dkblackley/bins-go/globals"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const IndexMetadataFile = "bins_index.json"
+
+// IndexMetadata describes how an index was built.
+type IndexMetadata struct {
+	Analyzer   string               `json:"analyzer"`
+	Docs       uint64               `json:"docs"`
+	Corpus     string               `json:"corpus"`
+	CorpusHash string               `json:"corpusSHA256"`
+	Fields     globals.CorpusFields `json:"fields"`
+	Report     CorpusReport         `json:"report"`
+}
+
+// BuildIndex (re)builds dataset.IndexDir from the corpus and writes its metadata.
+func BuildIndex(dataset globals.DatasetMetadata) (IndexMetadata, error) {
+	if dataset.IndexDir == "" {
+		return IndexMetadata{}, fmt.Errorf("dataset %s has no index directory", dataset.Name)
+	}
+
+	analyzer, err := NewAnalyzer(dataset.Analyzer)
+	if err != nil {
+		return IndexMetadata{}, err
+	}
+	hash, err := hashFile(dataset.OriginalDir)
+	if err != nil {
+		return IndexMetadata{}, err
+	}
+	report, err := writeIndex(dataset.OriginalDir, dataset.IndexDir, dataset.Fields, analyzer)
+	if err != nil {
+		return IndexMetadata{}, err
+	}
+	logrus.Infof("Corpus %s: %s", dataset.OriginalDir, report)
+
+	meta := IndexMetadata{
+		Analyzer:   analyzerName(dataset.Analyzer),
+		Docs:       uint64(report.Loaded),
+		Corpus:     dataset.OriginalDir,
+		CorpusHash: hash,
+		Fields:     dataset.Fields,
+		Report:     report,
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return meta, err
+	}
+	return meta, os.WriteFile(filepath.Join(dataset.IndexDir, IndexMetadataFile), data, 0o644)
+}
+
+// ReadIndexMetadata reads the metadata BuildIndex left in indexDir.
+func ReadIndexMetadata(indexDir string) (IndexMetadata, error) {
+	var meta IndexMetadata
+	data, err := os.ReadFile(filepath.Join(indexDir, IndexMetadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, fmt.Errorf("index %s has no %s, (re)build it with the index command", indexDir, IndexMetadataFile)
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("%s: %w", filepath.Join(indexDir, IndexMetadataFile), err)
+	}
+	return meta, nil
+}
+
+// CheckIndex checks reader is an index of dataset's corpus as it is now, built by BuildIndex with dataset's analyzer.
+func CheckIndex(reader *bluge.Reader, dataset globals.DatasetMetadata) error {
+	meta, err := ReadIndexMetadata(dataset.IndexDir)
+	if err != nil {
+		return err
+	}
+
+	if meta.Analyzer != analyzerName(dataset.Analyzer) {
+		return fmt.Errorf("index %s was analysed with %q, the dataset uses %q", dataset.IndexDir, meta.Analyzer,
+			analyzerName(dataset.Analyzer))
+	}
+	if !slices.Equal(meta.Fields.Title, dataset.Fields.Title) || !slices.Equal(meta.Fields.Text, dataset.Fields.Text) {
+		return fmt.Errorf("index %s was built from the fields %+v, the dataset says %+v", dataset.IndexDir, meta.Fields,
+			dataset.Fields)
+	}
+
+	count, err := reader.Count()
+	if err != nil {
+		return err
+	}
+	if count != meta.Docs {
+		return fmt.Errorf("index %s holds %d docs, its metadata says %d", dataset.IndexDir, count, meta.Docs)
+	}
+
+	hash, err := hashFile(dataset.OriginalDir)
+	if err != nil {
+		return err
+	}
+	if hash != meta.CorpusHash {
+		return fmt.Errorf("index %s was built from another corpus than %s, rebuild it with the index command",
+			dataset.IndexDir, dataset.OriginalDir)
+	}
+	return nil
+}
+
+// writeIndex indexes the title and body of every doc of the corpus at jsonlPath into a fresh index at indexDir, with
+// analyzer (bluge's standard analyzer if nil). The doc ID is also stored as "_id".
+func writeIndex(jsonlPath, indexDir string, fields globals.CorpusFields, analyzer *analysis.Analyzer) (CorpusReport, error) {
+	// Start fresh (important if you re-run)
+	if err := os.RemoveAll(indexDir); err != nil {
+		return CorpusReport{}, err
+	}
+	if err := os.MkdirAll(indexDir, 0o755); err != nil {
+		return CorpusReport{}, err
+	}
+
+	w, err := bluge.OpenWriter(bluge.DefaultConfig(indexDir))
+	if err != nil {
+		return CorpusReport{}, err
+	}
+
+	textField := func(name, value string) *bluge.TermField {
+		field := bluge.NewTextField(name, value)
+		if analyzer != nil {
+			field = field.WithAnalyzer(analyzer)
+		}
+		return field
+	}
+
+	bar := progressbar.Default(-1, "index "+indexDir)
+
+	batch := bluge.NewBatch()
+	const flushEvery = 2000
+	batchCount := 0
+	var batchErr error
+
+	report, err := StreamCorpus(jsonlPath, fields, func(d beirDoc) {
+		if batchErr != nil {
+			return
+		}
+
+		doc := bluge.NewDocument(d.ID)
+		if d.Title != "" {
+			doc.AddField(textField("title", d.Title))
+		}
+		if d.Text != "" {
+			doc.AddField(textField("body", d.Text))
+		}
+		// store _id so your VisitStoredFields logic still works
+		doc.AddField(bluge.NewKeywordField("_id", d.ID).StoreValue())
+
+		batch.Insert(doc)
+		batchCount++
+		bar.Add(1)
+
+		if batchCount >= flushEvery {
+			batchErr = w.Batch(batch)
+			batch = bluge.NewBatch()
+			batchCount = 0
+		}
+	})
+	bar.Finish()
+	if err == nil {
+		err = batchErr
+	}
+	if err == nil && batchCount > 0 {
+		err = w.Batch(batch)
+	}
+	if err != nil {
+		w.Close()
+		return report, err
+	}
+
+	// Ensure we actually created an index snapshot
+	if report.Loaded == 0 {
+		w.Close()
+		return report, fmt.Errorf("no documents indexed from %s (%s)", jsonlPath, report)
+	}
+
+	// Close writer and surface errors (snapshot persistence happens here as well)
+	return report, w.Close()
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
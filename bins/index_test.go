@@ -0,0 +1,129 @@
+package bins
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/blugelabs/bluge"
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func TestBuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	dataset := globals.DatasetMetadata{
+		Name:        "test",
+		IndexDir:    filepath.Join(dir, "index"),
+		OriginalDir: filepath.Join(dir, "corpus.jsonl"),
+	}
+	corpus := `{"_id": "d1", "title": "Private searching", "text": "The bins hold the documents."}
+{"_id": "d2", "title": "Graphs", "text": "Walking a graph privately."}
+`
+	if err := os.WriteFile(dataset.OriginalDir, []byte(corpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := BuildIndex(dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Docs != 2 || meta.Analyzer != AnalyzerStrictEnglish || meta.CorpusHash == "" {
+		t.Errorf("got metadata %+v", meta)
+	}
+
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(dataset.IndexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if err := CheckIndex(reader, dataset); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index terms are the stemmed vocab words
+	hits := searchTerm(reader, "privat", 10)
+	if len(hits) != 2 {
+		t.Errorf("privat got hits %v, want both docs", hits)
+	}
+
+	if err := os.WriteFile(dataset.OriginalDir, []byte(corpus+`{"_id": "d3", "text": "new"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIndex(reader, dataset); err == nil || !strings.Contains(err.Error(), "another corpus") {
+		t.Errorf("changed corpus got %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dataset.IndexDir, IndexMetadataFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIndex(reader, dataset); err == nil || !strings.Contains(err.Error(), "index command") {
+		t.Errorf("index without metadata got %v", err)
+	}
+}
+
+func TestAnalyzers(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"", "The private searches", []string{"privat", "search"}},
+		{AnalyzerEnglishNoStem, "The private searches", []string{"private", "searches"}},
+		{AnalyzerMultilingual, "Ｃafé 東京都", []string{"café", "京都", "東京"}},
+		{AnalyzerCharNgram, "Bins", []string{"bin", "bins", "ins"}},
+	}
+	for _, tt := range tests {
+		analyzer, err := NewAnalyzer(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, tok := range analyzer.Analyze([]byte(tt.text)) {
+			got = append(got, string(tok.Term))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q analysed %q into %q, want %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+
+	if _, err := NewAnalyzer("klingon"); err == nil || !strings.Contains(err.Error(), AnalyzerMultilingual) {
+		t.Errorf("unknown analyzer got %v", err)
+	}
+}
+
+func TestIndexAnalyzerMismatch(t *testing.T) {
+	dir := t.TempDir()
+	dataset := globals.DatasetMetadata{
+		Name:        "test",
+		IndexDir:    filepath.Join(dir, "index"),
+		OriginalDir: filepath.Join(dir, "corpus.jsonl"),
+		Analyzer:    AnalyzerEnglishNoStem,
+	}
+	if err := os.WriteFile(dataset.OriginalDir, []byte(`{"_id": "d1", "text": "private searches"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildIndex(dataset); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(dataset.IndexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// The unstemmed word is an index term, the stem isn't
+	if hits := searchTerm(reader, "searches", 10); len(hits) != 1 {
+		t.Errorf("searches got hits %v", hits)
+	}
+	if hits := searchTerm(reader, "search", 10); len(hits) != 0 {
+		t.Errorf("search got hits %v", hits)
+	}
+
+	dataset.Analyzer = ""
+	if err := CheckIndex(reader, dataset); err == nil || !strings.Contains(err.Error(), AnalyzerEnglishNoStem) {
+		t.Errorf("index of another analyzer got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package bins
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Keyword PIR layout. With plain hashed bins, unrelated terms that hash to the same bin get merged and a term that is
+// not in the vocabulary still fetches some arbitrary bin. Here every term gets a slot of its own in a cuckoo hash
+// table, and the entry in that slot starts with a tag derived from the term. The client fetches all the candidate
+// slots of a term and keeps only the one whose tag matches, so it learns if the term exists and gets back only that
+// term's documents.
+
+const (
+	keywordChoices   = 2          // number of candidate slots per term (the client queries all of them)
+	keywordTagChoice = 0xffffffff // hashTokenChoice index reserved for the tag, must never be a slot choice
+	keywordMaxKicks  = 1000       // evictions before we give up and grow the table
+	keywordLoad      = 0.45       // target load factor, two-choice cuckoo hashing falls over at ~0.5
+)
+
+// keywordSlots returns the candidate slots of term in a table with n slots.
+func keywordSlots(term string, n int) []uint64 {
+	slots := make([]uint64, keywordChoices)
+	for i := range slots {
+		slots[i] = hashTokenChoice(term, uint(i)) % uint64(n)
+	}
+	return slots
+}
+
+// keywordTag is the key tag stored as the first word of a term's entry. 0 is reserved for empty slots (PIR returns
+// all zeros for them).
+func keywordTag(term string) uint64 {
+	tag := hashTokenChoice(term, keywordTagChoice)
+	if tag == 0 {
+		tag = 1
+	}
+	return tag
+}
+
+// MakeKeywordDB places every term of postings into a cuckoo hash table. It returns the term stored in each slot ("" if
+// the slot is empty) and the matching doc IDs. The table has at least binSize slots and is grown until all the
+// terms fit.
+func MakeKeywordDB(postings map[string][]Posting, binSize uint) ([]string, [][]Posting) {
+
+	// Sort so the layout doesn't depend on map order
+	terms := make([]string, 0, len(postings))
+	for term := range postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	n := int(math.Ceil(float64(len(terms)) / keywordLoad))
+	if n < int(binSize) {
+		n = int(binSize)
+	}
+
+	for {
+		keys, ok := cuckooInsert(terms, n)
+		if ok {
+			logrus.Debugf("Keyword table: %d terms in %d slots (load %.2f)", len(terms), n, float64(len(terms))/float64(n))
+
+			slots := make([][]Posting, n)
+			for i, key := range keys {
+				if key != "" {
+					slots[i] = postings[key]
+				}
+			}
+			return keys, slots
+		}
+
+		logrus.Debugf("Cuckoo insertion failed with %d slots, growing the table", n)
+		n += n / 10
+	}
+}
+
+// cuckooInsert tries to place all the terms in a table of n slots. Returns false if an insertion kicked out more than
+// keywordMaxKicks terms.
+func cuckooInsert(terms []string, n int) ([]string, bool) {
+	keys := make([]string, n)
+
+	for _, term := range terms {
+		current := term
+		slot := keywordSlots(current, n)[0]
+
+		placed := false
+		for kick := 0; kick < keywordMaxKicks; kick++ {
+			// Take any free candidate slot first
+			for _, s := range keywordSlots(current, n) {
+				if keys[s] == "" {
+					keys[s] = current
+					placed = true
+					break
+				}
+			}
+			if placed {
+				break
+			}
+
+			// Otherwise evict whoever is in slot and send them to their next candidate
+			keys[slot], current = current, keys[slot]
+			candidates := keywordSlots(current, n)
+			for i, s := range candidates {
+				if s == slot {
+					slot = candidates[(i+1)%len(candidates)]
+					break
+				}
+			}
+		}
+
+		if !placed {
+			return nil, false
+		}
+	}
+
+	return keys, true
+}
+
+// keywordRows turns the keyword CSV layout ([term, "docID:score"...] per slot) back into the terms and bins.
+func keywordRows(rows [][]string) ([]string, [][]Posting, error) {
+	keys := make([]string, len(rows))
+	slots := make([][]Posting, len(rows))
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, nil, fmt.Errorf("keyword DB row %d has %d fields, want at least 2", i, len(row))
+		}
+		keys[i] = row[0]
+		slot, err := parsePostingCells(row[1:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("keyword DB row %d: %w", i, err)
+		}
+		slots[i] = slot
+	}
+	return keys, slots, nil
+}
+
+// keywordCSV is the inverse of keywordRows. Empty slots are written as ["", ""] so the CSV reader doesn't skip them.
+func keywordCSV(keys []string, slots [][]Posting) [][]string {
+	rows := make([][]string, len(keys))
+	for i := range keys {
+		row := append([]string{keys[i]}, postingCells(slots[i])...)
+		if len(row) < 2 {
+			row = append(row, "")
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// KeywordQuery fetches the candidate slots of every token in one PIR batch (padded to v.BatchSize) and checks their
+// tags. The returned map only holds tokens that are in the table, with the tag stripped from the entry.
+func (v VecBins) KeywordQuery(tokens []string) (map[string][]uint64, error) {
+	b := newQueryBatch(len(tokens) * keywordChoices)
+	for _, token := range tokens {
+		b.add(token, keywordSlots(token, v.N))
+	}
+	v.padBatch(b)
+
+	return v.keywordFetch(b)
+}
+
+// keywordFetch runs the batch and keeps, for every term in it, the slot whose tag matches. Slots are shared between
+// terms when their candidates collide, so each slot is checked against every term it was fetched for.
+func (v VecBins) keywordFetch(b *queryBatch) (map[string][]uint64, error) {
+	results, err := v.query(b.indices)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]uint64)
+	for i, entry := range results {
+		for _, term := range b.terms[i] {
+			if len(entry) > 1 && entry[0] == keywordTag(term) {
+				found[term] = entry[1:]
+			}
+		}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,101 @@
+package bins
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func TestKeywordTable(t *testing.T) {
+	postings := make(map[string][]Posting)
+	for i := 0; i < 500; i++ {
+		postings[fmt.Sprintf("term%d", i)] = []Posting{{fmt.Sprint(i), float64(i)}}
+	}
+
+	keys, slots := MakeKeywordDB(postings, 10)
+
+	// Every term should sit in one of its own candidate slots
+	for term, docs := range postings {
+		found := false
+		for _, s := range keywordSlots(term, len(keys)) {
+			if keys[s] == term {
+				found = true
+				if slots[s][0] != docs[0] {
+					t.Fatalf("slot of %s holds %v, want %v", term, slots[s], docs)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("%s is not in any of its candidate slots", term)
+		}
+	}
+
+	// The CSV layout has to survive empty slots
+	keys2, slots2, err := keywordRows(keywordCSV(keys, slots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys2) != len(keys) {
+		t.Fatalf("got %d slots back, want %d", len(keys2), len(keys))
+	}
+	for i := range keys {
+		if keys[i] != keys2[i] || len(slots[i]) != len(slots2[i]) || (len(slots[i]) > 0 && slots[i][0] != slots2[i][0]) {
+			t.Fatalf("slot %d changed: %q %v vs %q %v", i, keys[i], slots[i], keys2[i], slots2[i])
+		}
+	}
+}
+
+func TestKeywordQuery(t *testing.T) {
+	config := globals.Args{Dimensions: 2, BatchSize: 16}
+
+	postings := make(map[string][]Posting)
+	for i := 0; i < 100; i++ {
+		postings[fmt.Sprintf("term%d", i)] = []Posting{{fmt.Sprint(i), 1}}
+	}
+	keys, _ := MakeKeywordDB(postings, 0)
+
+	// Give each term's entry a single vector that identifies it
+	vectors := make([][][]float32, len(keys))
+	scores := make([][]uint16, len(keys))
+	docs := make([][]uint32, len(keys))
+	tags := make([]uint64, len(keys))
+	for i, key := range keys {
+		if key == "" {
+			continue
+		}
+		var id int
+		fmt.Sscanf(key, "term%d", &id)
+		vectors[i] = [][]float32{{float32(id), 1}}
+		scores[i] = []uint16{uint16(id + 1)}
+		docs[i] = []uint32{uint32(id)}
+		tags[i] = keywordTag(key)
+	}
+
+	v := ProcessVecDB(config, 1, vectors, scores, docs, tags)
+	v.PIR.Preprocessing()
+
+	// Repeated tokens share their slots, the rest of the batch is dummies
+	found, err := v.KeywordQuery([]string{"term7", "missing", "term42", "term7", "term42", "term7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := found["missing"]; ok {
+		t.Fatalf("found a term that is not in the table")
+	}
+	for _, id := range []int{7, 42} {
+		entry, ok := found[fmt.Sprintf("term%d", id)]
+		if !ok {
+			t.Fatalf("term%d not found", id)
+		}
+		rows, err := DecodeEntryToRows(entry, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0].Vector[0] != float32(id) || rows[0].Score != uint16(id+1) ||
+			rows[0].Doc != uint32(id) {
+			t.Fatalf("term%d decoded to %v", id, rows)
+		}
+	}
+}
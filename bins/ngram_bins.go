@@ -0,0 +1,65 @@
+package bins
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/blugelabs/bluge"
+)
+
+// N-gram bins. Next to every vocab word, runs of 2..config.Ngram consecutive tokens that show up at least
+// config.NgramMinFreq times in the corpus get binned as well. An n-gram is just another term to the bins: its key is the
+// tokens joined by ngramSep, which goes through hashTokenChoice, d-choice placement and the overflow policy exactly
+// like a unigram does. Queries fetch their unigrams first and then fill what is left of the batch with their n-grams.
+
+const (
+	ngramSep = " "
+	// Stopwords are dropped by the analyzer, so "bank of america" becomes the bigram "bank america". The phrase search
+	// allows this many positions of slack to still match the original text.
+	ngramSlop = 2
+	// A vocab scan worker counts this many distinct n-grams at most before it prunes the rare ones, see pruneRare.
+	// Most n-grams of a corpus are in a single doc, counting them all would take more memory than the corpus.
+	ngramScanCap = 1 << 22
+)
+
+// ngramTerms returns every run of 2..n consecutive tokens, shortest first and in query order within each length.
+func ngramTerms(tokens []string, n uint) []string {
+	var grams []string
+	for size := 2; size <= int(n); size++ {
+		for start := 0; start+size <= len(tokens); start++ {
+			grams = append(grams, strings.Join(tokens[start:start+size], ngramSep))
+		}
+	}
+	return grams
+}
+
+// pruneRare drops the n-grams counted less than floor times, raising floor until at most keep are left, and returns
+// the floor it got to. The next prune starts from there. An n-gram that was pruned starts counting from 0 again, so the
+// counts of the rare ones come out low; n-grams that are frequent throughout the corpus are never pruned.
+func pruneRare(counts map[string]uint, floor uint, keep int) uint {
+	for {
+		maps.DeleteFunc(counts, func(_ string, n uint) bool { return n < floor })
+		if len(counts) <= keep {
+			return floor
+		}
+		floor++
+	}
+}
+
+// isNgram reports if a bin key is an n-gram rather than a single word.
+func isNgram(term string) bool {
+	return strings.Contains(term, ngramSep)
+}
+
+// termQuery is the BM25 query that fills a term's bin: the word itself, or a phrase of the tokens of an n-gram. Terms
+// come out of the dataset's analyzer already, so they are looked up as they are.
+func termQuery(term string, field string) bluge.Query {
+	if isNgram(term) {
+		var phrase [][]string
+		for _, t := range strings.Split(term, ngramSep) {
+			phrase = append(phrase, []string{t})
+		}
+		return bluge.NewMultiPhraseQuery(phrase).SetField(field).SetSlop(ngramSlop)
+	}
+	return bluge.NewTermQuery(term).SetField(field)
+}
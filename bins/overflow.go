@@ -0,0 +1,219 @@
+package bins
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/dkblackley/bins-go/globals"
+	"github.com/sirupsen/logrus"
+)
+
+// Overflow policies for bins that hold more than config.Threshold docs. The biggest bin sets MaxDBEntrySize for the
+// whole PIR DB, so a handful of huge bins make every query expensive.
+const (
+	OverflowDrop  = "drop"  // keep the Threshold best scored docs, drop the rest
+	OverflowSpill = "spill" // move the extra docs into a shared region of overflow bins, drop what doesn't fit there
+	OverflowSplit = "split" // spread every bin over as many PIR rows as the biggest bin needs
+)
+
+// binLayout describes how the logical bins (what tokens hash into) map onto rows of the PIR DB.
+type binLayout struct {
+	Bins         int // number of logical bins
+	OverflowBins int // spill: rows Bins..Bins+OverflowBins-1 hold the spilled docs
+	SplitParts   int // split: bin b lives in rows b*SplitParts..(b+1)*SplitParts-1
+}
+
+// rows returns every PIR row the client has to fetch to get all of bin.
+func (l binLayout) rows(bin uint64) []uint64 {
+	if l.SplitParts > 1 {
+		rows := make([]uint64, l.SplitParts)
+		for p := range rows {
+			rows[p] = bin*uint64(l.SplitParts) + uint64(p)
+		}
+		return rows
+	}
+	if l.OverflowBins > 0 {
+		return []uint64{bin, uint64(l.Bins) + bin%uint64(l.OverflowBins)}
+	}
+	return []uint64{bin}
+}
+
+// layoutFromRows recovers the layout of a saved DB from its number of rows.
+func layoutFromRows(config globals.Args, rows int) (binLayout, error) {
+	layout := binLayout{Bins: int(config.BinSize), SplitParts: 1}
+	if config.Threshold == 0 {
+		return layout, nil
+	}
+
+	switch config.Overflow {
+	case OverflowDrop:
+	case OverflowSpill:
+		layout.OverflowBins = rows - layout.Bins
+	case OverflowSplit:
+		if rows%layout.Bins != 0 {
+			return layout, fmt.Errorf("split DB has %d rows, not a multiple of %d bins", rows, layout.Bins)
+		}
+		layout.SplitParts = rows / layout.Bins
+	default:
+		return layout, fmt.Errorf("unknown overflow policy %q", config.Overflow)
+	}
+	return layout, nil
+}
+
+// applyOverflow turns the bins into PIR rows, capping every row at config.Threshold docs (0 means no cap).
+func applyOverflow(setsBins map[uint]map[string]float64, config globals.Args) ([][]Posting, binLayout) {
+	binSize := int(config.BinSize)
+	capacity := int(config.Threshold)
+	layout := binLayout{Bins: binSize, SplitParts: 1}
+
+	ranked := make([][]Posting, binSize)
+	biggest := 0
+	for bin, set := range setsBins {
+		ranked[bin] = rankBin(set)
+		biggest = max(biggest, len(set))
+	}
+
+	if capacity == 0 || biggest <= capacity {
+		return ranked, layout
+	}
+
+	switch config.Overflow {
+	case OverflowDrop:
+		for b := range ranked {
+			if len(ranked[b]) > capacity {
+				ranked[b] = ranked[b][:capacity]
+			}
+		}
+		return ranked, layout
+
+	case OverflowSpill:
+		layout.OverflowBins = int(config.OverflowBins)
+		if layout.OverflowBins == 0 {
+			layout.OverflowBins = max(binSize/10, 1)
+		}
+
+		rows := make([][]Posting, binSize+layout.OverflowBins)
+		inRow := make([]map[string]struct{}, layout.OverflowBins)
+		for b := range ranked {
+			if len(ranked[b]) <= capacity {
+				rows[b] = ranked[b]
+				continue
+			}
+			rows[b] = ranked[b][:capacity]
+
+			o := layout.rows(uint64(b))[1]
+			seen := inRow[o-uint64(binSize)]
+			if seen == nil {
+				seen = make(map[string]struct{})
+				inRow[o-uint64(binSize)] = seen
+			}
+			for _, p := range ranked[b][capacity:] {
+				if len(rows[o]) >= capacity {
+					break // overflow bin is full too, the rest gets dropped
+				}
+				if _, ok := seen[p.DocID]; ok {
+					continue
+				}
+				seen[p.DocID] = struct{}{}
+				rows[o] = append(rows[o], p)
+			}
+		}
+		return rows, layout
+
+	case OverflowSplit:
+		layout.SplitParts = (biggest + capacity - 1) / capacity
+
+		rows := make([][]Posting, binSize*layout.SplitParts)
+		for b := range ranked {
+			for p := 0; p < layout.SplitParts; p++ {
+				start := min(p*capacity, len(ranked[b]))
+				end := min((p+1)*capacity, len(ranked[b]))
+				rows[b*layout.SplitParts+p] = ranked[b][start:end]
+			}
+		}
+		return rows, layout
+
+	default:
+		logrus.Fatalf("Unknown overflow policy %q, options are %s|%s|%s", config.Overflow, OverflowDrop, OverflowSpill,
+			OverflowSplit)
+		return nil, layout
+	}
+}
+
+// rankBin orders the docs of a bin best score first (ties by doc ID so the order is stable).
+func rankBin(set map[string]float64) []Posting {
+	ranked := make([]Posting, 0, len(set))
+	for docID, score := range set {
+		ranked = append(ranked, Posting{docID, score})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].DocID < ranked[j].DocID
+	})
+	return ranked
+}
+
+// logOverflowStats logs a histogram of the row sizes and how many (word, doc) postings can no longer be retrieved
+// from the rows the client fetches for that word.
+func logOverflowStats(postings map[string][]Posting, placement map[string]uint, rows [][]Posting, layout binLayout,
+	config globals.Args) {
+
+	// Power of two buckets: bucket i holds rows with size in [2^(i-1), 2^i)
+	histogram := make([]int, 0)
+	for _, row := range rows {
+		bucket := bits.Len(uint(len(row)))
+		for len(histogram) <= bucket {
+			histogram = append(histogram, 0)
+		}
+		histogram[bucket]++
+	}
+
+	var sb strings.Builder
+	for bucket, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		if bucket == 0 {
+			fmt.Fprintf(&sb, " [0]=%d", count)
+		} else {
+			fmt.Fprintf(&sb, " [%d,%d)=%d", 1<<(bucket-1), 1<<bucket, count)
+		}
+	}
+	logrus.Debugf("Row sizes (%s, thresh=%d, %d rows):%s", config.Overflow, config.Threshold, len(rows), sb.String())
+
+	rowSets := make([]map[string]struct{}, len(rows))
+	for i, row := range rows {
+		rowSets[i] = make(map[string]struct{}, len(row))
+		for _, p := range row {
+			rowSets[i][p.DocID] = struct{}{}
+		}
+	}
+
+	total, lost := 0, 0
+	for word, hits := range postings {
+		bin := binCandidates(word, config.DChoice, config.BinSize)[placement[word]]
+		fetched := layout.rows(bin)
+		for _, p := range hits {
+			total++
+			found := false
+			for _, r := range fetched {
+				if _, ok := rowSets[r][p.DocID]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				lost++
+			}
+		}
+	}
+
+	if total > 0 {
+		logrus.Debugf("Overflow recall loss: %d of %d postings (%.2f%%) no longer retrievable", lost, total,
+			100*float64(lost)/float64(total))
+	}
+}
@@ -0,0 +1,217 @@
+package bins
+
+// Building the bins straight from the postings lists of the bluge index. MakeUnigramPostings used to run a top-K
+// search per vocab word, which on MS MARCO is millions of searches that each set up a searcher, a collector and a pool
+// of matches. Every word's hits are really just a walk over the postings lists of its title and body terms, scoring
+// each doc with the same BM25 the search would use and keeping the best K in a heap.
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	segment "github.com/blugelabs/bluge_segment_api"
+	"github.com/sirupsen/logrus"
+)
+
+// How MakeUnigramPostings finds the hits of every word.
+const (
+	BinBuilderPostings = "postings" // walk the postings lists of the index (see topKPostings)
+	BinBuilderSearch   = "search"   // one bluge top-K search per word
+	BinBuilderCompare  = "compare"  // both, log every word they disagree on and keep the search hits
+)
+
+func validBinBuilder(builder string) bool {
+	return builder == BinBuilderPostings || builder == BinBuilderSearch || builder == BinBuilderCompare
+}
+
+// snapshotRequest is a search that matches nothing. It only exists to get at the index snapshot behind a bluge.Reader,
+// which bluge doesn't export but hands to every request's Searcher. fn runs while the search holds the snapshot.
+type snapshotRequest struct {
+	*bluge.TopNSearch
+	fn func(snapshot search.Reader, config bluge.Config) error
+}
+
+func (r snapshotRequest) Searcher(i search.Reader, config bluge.Config) (search.Searcher, error) {
+	if err := r.fn(i, config); err != nil {
+		return nil, err
+	}
+	return r.TopNSearch.Searcher(i, config)
+}
+
+// withSnapshot calls fn with the snapshot reader searches and the config it was opened with.
+func withSnapshot(reader *bluge.Reader, fn func(snapshot search.Reader, config bluge.Config) error) error {
+	req := snapshotRequest{
+		TopNSearch: bluge.NewTopNSearch(0, bluge.NewMatchNoneQuery()),
+		fn:         fn,
+	}
+	_, err := reader.Search(context.Background(), req)
+	return err
+}
+
+// postingCursor walks the postings list of the term in one field, in doc number order.
+type postingCursor struct {
+	it     segment.PostingsIterator
+	scorer search.Scorer
+	cur    segment.Posting // nil once the list is done
+}
+
+// scoredDoc is a doc number of the snapshot and its score.
+type scoredDoc struct {
+	num   uint64
+	score float64
+}
+
+// worse is the order the top-K search ranks hits in, reversed: lower score first, then the later doc.
+func (a scoredDoc) worse(b scoredDoc) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.num > b.num
+}
+
+// topKHeap keeps the worst of the hits kept so far on top.
+type topKHeap []scoredDoc
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].worse(h[j]) }
+func (h topKHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topKHeap) Push(x any)        { *h = append(*h, x.(scoredDoc)) }
+func (h *topKHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// topKPostings returns the same hits, in the same order and with the same scores, as searchTerm does for a single word:
+// every doc scores the sum of the BM25 scores of the word in its title and body. N-grams need positions, so they still
+// go through searchTerm.
+func topKPostings(snapshot search.Reader, config bluge.Config, word string, k uint) ([]Posting, error) {
+	if k == 0 {
+		return nil, nil
+	}
+
+	// Same field order as searchTerm's boolean query, so the scores add up in the same order
+	var cursors []*postingCursor
+	defer func() {
+		for _, c := range cursors {
+			c.it.Close()
+		}
+	}()
+	for _, field := range []string{"title", "body"} {
+		stats, err := snapshot.CollectionStats(field)
+		if err != nil {
+			return nil, err
+		}
+		similarity := config.DefaultSimilarity
+		if s, ok := config.PerFieldSimilarity[field]; ok {
+			similarity = s
+		}
+
+		it, err := snapshot.PostingsIterator([]byte(word), field, true, true, false)
+		if err != nil {
+			return nil, err
+		}
+		c := &postingCursor{it: it, scorer: similarity.Scorer(1, stats, docFrequency(it.Count()))}
+		cursors = append(cursors, c)
+		if c.cur, err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+
+	best := make(topKHeap, 0, k)
+	for {
+		num := uint64(math.MaxUint64)
+		for _, c := range cursors {
+			if c.cur != nil {
+				num = min(num, c.cur.Number())
+			}
+		}
+		if num == math.MaxUint64 {
+			break
+		}
+
+		doc := scoredDoc{num: num}
+		for _, c := range cursors {
+			if c.cur == nil || c.cur.Number() != num {
+				continue
+			}
+			doc.score += c.scorer.Score(c.cur.Frequency(), c.cur.Norm())
+			var err error
+			if c.cur, err = c.it.Next(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case len(best) < int(k):
+			heap.Push(&best, doc)
+		case best[0].worse(doc):
+			best[0] = doc
+			heap.Fix(&best, 0)
+		}
+	}
+
+	sort.Slice(best, func(i, j int) bool { return best[j].worse(best[i]) })
+
+	var hits []Posting
+	for _, doc := range best {
+		var docID string
+		err := snapshot.VisitStoredFields(doc.num, func(field string, value []byte) bool {
+			if field == "_id" {
+				docID = string(value)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, Posting{docID, doc.score})
+	}
+	return hits, nil
+}
+
+// docFrequency is the term stats a scorer needs, the number of docs in the postings list.
+type docFrequency uint64
+
+func (d docFrequency) DocumentFrequency() uint64 { return uint64(d) }
+
+// comparePostings logs every word whose postings and search hits differ and returns how many did.
+func comparePostings(fromPostings, fromSearch map[string][]Posting) int {
+	differ := 0
+	for word, hits := range fromSearch {
+		if diff := postingsDiff(fromPostings[word], hits); diff != "" {
+			differ++
+			logrus.Debugf("Postings and search disagree on %q: %s", word, diff)
+		}
+	}
+	for word := range fromPostings {
+		if _, ok := fromSearch[word]; !ok {
+			differ++
+			logrus.Debugf("Postings kept %q but search dropped it", word)
+		}
+	}
+	return differ
+}
+
+// postingsDiff describes the first difference between two hit lists, or is empty if they match. Scores only need to be
+// within float rounding of each other.
+func postingsDiff(got, want []Posting) string {
+	if len(got) != len(want) {
+		return fmt.Sprintf("%d hits vs %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].DocID != want[i].DocID {
+			return fmt.Sprintf("hit %d is %s vs %s", i, got[i].DocID, want[i].DocID)
+		}
+		if math.Abs(got[i].Score-want[i].Score) > 1e-9*max(1, math.Abs(want[i].Score)) {
+			return fmt.Sprintf("hit %d (%s) scored %g vs %g", i, got[i].DocID, got[i].Score, want[i].Score)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,187 @@
+package bins
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Query budgeting. The server sees how many indices are in a batch, so if every query term became an index it would
+// learn how long the query is. Instead every query sends exactly BatchSize indices: when a query has more terms than
+// fit, the token policy decides which ones are kept, and when it has fewer the batch is padded with dummy indices
+// (uniformly random rows whose results are thrown away). A BatchSize of 0 sends every term and no dummies, as the
+// baseline that leaks the query length.
+
+const (
+	TokenPolicyIDF      = "idf"      // rarest terms first
+	TokenPolicyStopword = "stopword" // query order, but stopword-like terms go last
+	TokenPolicyFirst    = "first"    // query order
+
+	stopwordDocFrac = 0.1 // terms in more than this fraction of the docs count as stopword-like
+)
+
+// termStats are the corpus statistics clients rank query terms with. Like the placement hint they are public, they say
+// nothing about any one query.
+type termStats struct {
+	Docs    int
+	DocFreq map[string]uint // only terms that made it into the bins
+}
+
+// idf is the BM25 IDF of term. Terms that aren't binned get 0, fetching them brings back nothing of theirs.
+func (s termStats) idf(term string) float64 {
+	df := s.DocFreq[term]
+	if df == 0 {
+		return 0
+	}
+	return math.Log(1 + (float64(s.Docs)-float64(df)+0.5)/(float64(df)+0.5))
+}
+
+func (s termStats) stopwordLike(term string) bool {
+	return s.Docs > 0 && float64(s.DocFreq[term]) > stopwordDocFrac*float64(s.Docs)
+}
+
+// rankTerms orders terms by how much we want them in the batch under policy, ties keep the query order.
+func (s termStats) rankTerms(terms []string, policy string) []string {
+	ranked := slices.Clone(terms)
+	switch policy {
+	case TokenPolicyIDF:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return s.idf(ranked[i]) > s.idf(ranked[j])
+		})
+	case TokenPolicyStopword:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return !s.stopwordLike(ranked[i]) && s.stopwordLike(ranked[j])
+		})
+	}
+	return ranked
+}
+
+func validTokenPolicy(policy string) bool {
+	return policy == TokenPolicyIDF || policy == TokenPolicyStopword || policy == TokenPolicyFirst
+}
+
+// queryBatch is the set of distinct PIR indices a query fetches. Repeated terms, and terms whose bins collide, share
+// their indices instead of fetching them twice: PIR would serve the second copy from the client's local cache and skip
+// the sub-query, which the server can tell apart from a real or dummy query.
+type queryBatch struct {
+	indices []uint64
+	terms   [][]string // terms[i] are the terms indices[i] is fetched for, nil for dummies
+	pos     map[uint64]int
+}
+
+func newQueryBatch(size int) *queryBatch {
+	return &queryBatch{
+		indices: make([]uint64, 0, size),
+		terms:   make([][]string, 0, size),
+		pos:     make(map[uint64]int, size),
+	}
+}
+
+// cost is the number of new indices fetching rows would add to the batch.
+func (b *queryBatch) cost(rows []uint64) int {
+	fresh := make(map[uint64]struct{}, len(rows))
+	for _, row := range rows {
+		if _, ok := b.pos[row]; !ok {
+			fresh[row] = struct{}{}
+		}
+	}
+	return len(fresh)
+}
+
+// add fetches rows for term, reusing the indices that are already in the batch.
+func (b *queryBatch) add(term string, rows []uint64) {
+	for _, row := range rows {
+		i, ok := b.pos[row]
+		if !ok {
+			i = len(b.indices)
+			b.pos[row] = i
+			b.indices = append(b.indices, row)
+			b.terms = append(b.terms, nil)
+		}
+		if !slices.Contains(b.terms[i], term) {
+			b.terms[i] = append(b.terms[i], term)
+		}
+	}
+}
+
+// fillBatch picks the query terms that go into the batch: unigrams before n-grams, each in policy order, every distinct
+// term once, for as long as their rows still fit in v.BatchSize (all of them if it is 0). The rest of the batch is
+// dummies.
+func (v VecBins) fillBatch(QID string, rowsOf func(term string) []uint64) *queryBatch {
+	unigrams := v.queryTokens(QID)
+
+	b := newQueryBatch(v.BatchSize)
+	seen := make(map[string]struct{})
+	for _, terms := range [][]string{unigrams, ngramTerms(unigrams, v.Ngram)} {
+		for _, term := range v.Stats.rankTerms(terms, v.TokenPolicy) {
+			if _, ok := seen[term]; ok {
+				continue
+			}
+			seen[term] = struct{}{}
+
+			rows := rowsOf(term)
+			if v.BatchSize > 0 && len(b.indices)+b.cost(rows) > v.BatchSize {
+				logrus.Tracef("QID %s: no room left in the batch for %q", QID, term)
+				continue
+			}
+			b.add(term, rows)
+		}
+	}
+
+	v.padBatch(b)
+	return b
+}
+
+// padBatch fills b up to v.BatchSize with dummy indices, all distinct from each other and from the real ones (so a DB
+// smaller than the batch can't be padded all the way). A BatchSize of 0 adds none.
+func (v VecBins) padBatch(b *queryBatch) {
+	for len(b.indices) < min(v.BatchSize, v.N) {
+		row := uint64(v.Rand.Int63n(int64(v.N)))
+		if _, ok := b.pos[row]; ok {
+			continue
+		}
+		b.pos[row] = len(b.indices)
+		b.indices = append(b.indices, row)
+		b.terms = append(b.terms, nil)
+	}
+}
+
+// docFreqCSV writes the term stats as [term, doc frequency] rows sorted by term, after a first ["", number of docs] row.
+func docFreqCSV(stats termStats) [][]string {
+	terms := make([]string, 0, len(stats.DocFreq))
+	for term := range stats.DocFreq {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	rows := make([][]string, 0, len(terms)+1)
+	rows = append(rows, []string{"", strconv.Itoa(stats.Docs)})
+	for _, term := range terms {
+		rows = append(rows, []string{term, strconv.FormatUint(uint64(stats.DocFreq[term]), 10)})
+	}
+	return rows
+}
+
+// docFreqRows is the inverse of docFreqCSV.
+func docFreqRows(rows [][]string) (termStats, error) {
+	stats := termStats{DocFreq: make(map[string]uint, len(rows))}
+	for i, row := range rows {
+		if len(row) != 2 {
+			return stats, fmt.Errorf("doc frequency row %d has %d fields, want 2", i, len(row))
+		}
+		n, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("doc frequency row %d: %w", i, err)
+		}
+		if i == 0 {
+			stats.Docs = int(n)
+			continue
+		}
+		stats.DocFreq[row[0]] = uint(n)
+	}
+	return stats, nil
+}
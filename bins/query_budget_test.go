@@ -0,0 +1,225 @@
+package bins
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func testBins(text string, bins int, batch int) VecBins {
+	return VecBins{
+		N:             bins,
+		Queries:       map[string]Query{"q": {ID: "q", Text: text}},
+		TokenAnalyzer: strictEnglishAnalyzer(),
+		DChoice:       2,
+		Layout:        binLayout{Bins: bins, SplitParts: 1},
+		BatchSize:     batch,
+		TokenPolicy:   TokenPolicyFirst,
+		Rand:          rand.New(rand.NewSource(1)),
+	}
+}
+
+// checkBatch checks the batch is full, has no repeated index and that wantTerms are fetched exactly where their rows are.
+func checkBatch(t *testing.T, v VecBins, indices []uint64, terms [][]string, wantTerms []string) {
+	t.Helper()
+
+	if len(indices) != v.BatchSize || len(terms) != len(indices) {
+		t.Fatalf("got %d indices and %d term lists, want %d", len(indices), len(terms), v.BatchSize)
+	}
+
+	seen := make(map[uint64]bool)
+	fetchedFor := make(map[string]map[uint64]bool)
+	for i, index := range indices {
+		if seen[index] {
+			t.Fatalf("index %d is in the batch twice: %v", index, indices)
+		}
+		seen[index] = true
+		for _, term := range terms[i] {
+			if fetchedFor[term] == nil {
+				fetchedFor[term] = make(map[uint64]bool)
+			}
+			if fetchedFor[term][index] {
+				t.Fatalf("%q is listed twice for index %d", term, index)
+			}
+			fetchedFor[term][index] = true
+		}
+	}
+
+	if len(fetchedFor) != len(wantTerms) {
+		t.Fatalf("batch holds terms %v, want %v", fetchedFor, wantTerms)
+	}
+	for _, term := range wantTerms {
+		for _, row := range v.termRows(term, "q") {
+			if !fetchedFor[term][row] {
+				t.Fatalf("row %d of %q is not fetched for it", row, term)
+			}
+		}
+	}
+}
+
+func TestMakeIndicesRepeatedTokens(t *testing.T) {
+	v := testBins("cats cats dogs Cats cats dogs cat", 64, 8)
+
+	indices, terms := v.MakeIndices("q")
+	checkBatch(t, v, indices, terms, []string{"cat", "dog"})
+}
+
+func TestMakeIndicesCollidingBins(t *testing.T) {
+	// With a single bin every candidate of every term is row 0
+	v := testBins("cats dogs birds fish cats", 16, 8)
+	v.Layout.Bins = 1
+
+	indices, terms := v.MakeIndices("q")
+	checkBatch(t, v, indices, terms, []string{"cat", "dog", "bird", "fish"})
+	if indices[0] != 0 || len(terms[0]) != 4 {
+		t.Fatalf("row 0 should be fetched once for all 4 terms, got %v %v", indices, terms)
+	}
+}
+
+func TestMakeIndicesSmallDB(t *testing.T) {
+	// Can't pad to 8 distinct rows with only 3 of them
+	v := testBins("cats cats", 3, 8)
+
+	indices, _ := v.MakeIndices("q")
+	if len(indices) != 3 {
+		t.Fatalf("got %d indices, want 3", len(indices))
+	}
+}
+
+func TestRandSeed(t *testing.T) {
+	// A run that saved its seed and one that was restarted from it pad with the same dummies
+	saved := testBins("cats", 64, 8)
+	saved.MakeIndices("q")
+	seed := saved.RandSeed()
+	resumed := testBins("cats", 64, 8)
+	resumed.SetRandSeed(seed)
+
+	for range 3 {
+		want, _ := saved.MakeIndices("q")
+		got, _ := resumed.MakeIndices("q")
+		if !slices.Equal(got, want) {
+			t.Fatalf("resumed run padded with %v, saved one with %v", got, want)
+		}
+	}
+}
+
+func TestMakeIndicesUnpadded(t *testing.T) {
+	v := testBins("cats dogs birds fish cats", 64, 0)
+
+	indices, terms := v.MakeIndices("q")
+	want := make(map[uint64]bool)
+	for _, term := range []string{"cat", "dog", "bird", "fish"} {
+		for _, row := range v.termRows(term, "q") {
+			want[row] = true
+		}
+	}
+	if len(indices) != len(want) || len(terms) != len(indices) {
+		t.Fatalf("got %d indices for %d rows of the terms: %v %v", len(indices), len(want), indices, terms)
+	}
+	for _, index := range indices {
+		if !want[index] {
+			t.Fatalf("index %d is a dummy, the batch shouldn't be padded: %v", index, indices)
+		}
+	}
+}
+
+// testPIRBins is testBins over a preprocessed PIR DB where bin b holds a single doc b whose vector is (b, 0) and whose
+// score is b+1.
+func testPIRBins(text string) VecBins {
+	return testPIRBinsFilled(text, func(int) bool { return true })
+}
+
+// testPIRBinsFilled is testPIRBins with a doc only in the bins filled picks, the rest are left empty.
+func testPIRBinsFilled(text string, filled func(bin int) bool) VecBins {
+	config := globals.Args{Dimensions: 2, BatchSize: 16}
+	const bins = 2048
+
+	vectors := make([][][]float32, bins)
+	scores := make([][]uint16, bins)
+	docs := make([][]uint32, bins)
+	for b := range vectors {
+		if !filled(b) {
+			continue
+		}
+		vectors[b] = [][]float32{{float32(b), 0}}
+		scores[b] = []uint16{uint16(b + 1)}
+		docs[b] = []uint32{uint32(b)}
+	}
+
+	v := ProcessVecDB(config, 1, vectors, scores, docs, nil)
+	v.PIR.Preprocessing()
+	q := testBins(text, bins, 16)
+	v.Queries, v.TokenAnalyzer, v.DChoice, v.Layout = q.Queries, q.TokenAnalyzer, q.DChoice, q.Layout
+	v.TokenPolicy = q.TokenPolicy
+	return v
+}
+
+func TestDoSearchDuplicates(t *testing.T) {
+	v := testPIRBins("cats dogs cats cats dogs cats")
+
+	decodable, err := v.DoSearch("q", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := decodable.(DBentry)
+
+	// Every candidate row of cat and dog comes back once per term, and nothing else
+	want := make(map[string]int)
+	for _, term := range []string{"cat", "dog"} {
+		for _, row := range v.termRows(term, "q") {
+			want[fmt.Sprint(term, row)]++
+		}
+	}
+	got := make(map[string]int)
+	for i, result := range entry.entry {
+		rows, err := DecodeEntryToRows(result, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("result %d decoded to %d rows", i, len(rows))
+		}
+		got[fmt.Sprint(entry.tokens[i], rows[0].Doc)]++
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got results %v, want %v", got, want)
+	}
+	for key := range want {
+		if got[key] != 1 {
+			t.Fatalf("got results %v, want %v", got, want)
+		}
+	}
+}
+
+func TestNonPrivateMatchesPrivate(t *testing.T) {
+	config := globals.Args{Dimensions: 2, K: 10}
+	for _, tc := range []struct {
+		name   string
+		filled func(bin int) bool
+	}{
+		{"full", func(int) bool { return true }},
+		{"empty bins", func(bin int) bool { return bin%2 == 0 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := testPIRBinsFilled("cats dogs birds", tc.filled)
+			private, err := v.DoSearch("q", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.SetNonPrivateMode(true)
+			plain, err := v.DoSearch("q", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := private.Decode(config)
+			got := plain.Decode(config)
+			if !slices.Equal(got, want) {
+				t.Fatalf("plaintext answered %v, PIR answered %v", got, want)
+			}
+		})
+	}
+}
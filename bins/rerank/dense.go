@@ -0,0 +1,102 @@
+// Package rerank re-ranks the docs that come back from the bins against the dense query embedding, on the client. The
+// vectors are already in the bin entries, so this costs no extra PIR queries. It lives outside of bins so bins doesn't
+// have to pull in the (cgo) graphann package.
+package rerank
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dkblackley/bins-go/Pacmann/graphann"
+	"github.com/dkblackley/bins-go/bins"
+	"github.com/dkblackley/bins-go/globals"
+)
+
+const (
+	MetricNone = "none" // keep the BM25 order
+	MetricIP   = "ip"   // inner product, higher is better
+	MetricL2   = "l2"   // squared L2 distance, lower is better
+)
+
+// Candidater is a search result that can hand over every doc it found along with its vector.
+type Candidater interface {
+	Candidates(config globals.Args) []bins.Candidate
+}
+
+type DenseReRanker struct {
+	Metric  string
+	queries map[string][]float32 // QID -> query embedding
+}
+
+// NewDenseReRanker loads the query embeddings from config.DatasetMeta.Vectors.QueryVec. Row i of the file is the
+// embedding of query i of the query file (the same order Pacmann assumes).
+func NewDenseReRanker(config globals.Args, metric string) (*DenseReRanker, error) {
+	if metric != MetricIP && metric != MetricL2 {
+		return nil, fmt.Errorf("unknown re-rank metric %q, options are %s|%s|%s", metric, MetricNone, MetricIP,
+			MetricL2)
+	}
+
+	meta := config.DatasetMeta
+	queries, err := bins.LoadQueries(meta.Queries)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := globals.LoadFloat32MatrixFromNpy(meta.Vectors.QueryVec, len(queries), int(config.Dimensions))
+	if err != nil {
+		return nil, err
+	}
+
+	queryMap := make(map[string][]float32, len(queries))
+	for i, q := range queries {
+		queryMap[q.ID] = vectors[i]
+	}
+
+	return &DenseReRanker{Metric: metric, queries: queryMap}, nil
+}
+
+// ReRank scores the candidates of QID against its embedding and returns the top k doc IDs, best first, with their
+// scores (the inner product, or the negated L2 distance so higher is always better).
+func (r *DenseReRanker) ReRank(QID string, candidates []bins.Candidate, k int) ([]string, []float64, error) {
+	query, ok := r.queries[QID]
+	if !ok {
+		return nil, nil, fmt.Errorf("no query vector for QID %s", QID)
+	}
+
+	scored := make([]bins.Candidate, len(candidates))
+	for i, c := range candidates {
+		if len(c.Vector) != len(query) {
+			return nil, nil, fmt.Errorf("doc %s has dimension %d, query has %d", c.DocID, len(c.Vector), len(query))
+		}
+		scored[i] = bins.Candidate{DocID: c.DocID, Vector: c.Vector, Score: r.score(query, c.Vector)}
+	}
+
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].Score != scored[j].Score {
+			return scored[i].Score > scored[j].Score
+		}
+		return scored[i].DocID < scored[j].DocID
+	})
+	if k > 0 && len(scored) > k {
+		scored = scored[:k]
+	}
+
+	docIDs := make([]string, len(scored))
+	scores := make([]float64, len(scored))
+	for i, c := range scored {
+		docIDs[i] = c.DocID
+		scores[i] = c.Score
+	}
+	return docIDs, scores, nil
+}
+
+func (r *DenseReRanker) score(query, vector []float32) float64 {
+	if r.Metric == MetricL2 {
+		return -float64(graphann.L2Dist(query, vector))
+	}
+
+	var dot float32
+	for i := range query {
+		dot += query[i] * vector[i]
+	}
+	return float64(dot)
+}
@@ -0,0 +1,40 @@
+package rerank
+
+import (
+	"testing"
+
+	"github.com/dkblackley/bins-go/bins"
+)
+
+func TestReRank(t *testing.T) {
+	query := make([]float32, 8)
+	query[0] = 1
+
+	// BM25 order is a, b, c but c is the closest to the query and b the furthest
+	vector := func(x, y float32) []float32 {
+		v := make([]float32, 8)
+		v[0], v[1] = x, y
+		return v
+	}
+	candidates := []bins.Candidate{
+		{DocID: "a", Score: 3, Vector: vector(0.5, 0)},
+		{DocID: "b", Score: 2, Vector: vector(-1, 0)},
+		{DocID: "c", Score: 1, Vector: vector(0.9, 0.1)},
+	}
+
+	for _, metric := range []string{MetricIP, MetricL2} {
+		r := &DenseReRanker{Metric: metric, queries: map[string][]float32{"q": query}}
+		docIDs, scores, err := r.ReRank("q", candidates, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docIDs) != 2 || docIDs[0] != "c" || docIDs[1] != "a" || scores[0] < scores[1] {
+			t.Fatalf("%s: got %v %v, want [c a]", metric, docIDs, scores)
+		}
+	}
+
+	r := &DenseReRanker{Metric: MetricIP, queries: map[string][]float32{"q": query}}
+	if _, _, err := r.ReRank("missing", candidates, 2); err == nil {
+		t.Fatalf("re-ranking a QID without a vector should fail")
+	}
+}
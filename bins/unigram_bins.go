@@ -3,8 +3,7 @@
 // and either (A) build a simple token->docs lookup using single-term BM25,
 // or (B) assign each token to D hash bins without any scoring.
 //
-// Drop this next to your existing files (package main). If you already
-// declared the BM25 interface or NgramIndex elsewhere, delete the duplicates.
+// Longer n-grams go through the same bins, see ngram_bins.go.
 
 package bins
 
@@ -13,14 +12,16 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"regexp"
+	"maps"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/blugelabs/bluge"
 	"github.com/blugelabs/bluge/analysis"
-	"github.com/blugelabs/bluge/analysis/char"
-	"github.com/blugelabs/bluge/analysis/lang/en"
-	"github.com/blugelabs/bluge/analysis/token"
-	"github.com/blugelabs/bluge/analysis/tokenizer"
+	blugesearch "github.com/blugelabs/bluge/search"
 	"github.com/dkblackley/bins-go/globals"
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
@@ -38,182 +39,466 @@ func doBM25Search(queries []string, path_to_corpus string) {
 
 }
 
-func strictEnglishAnalyzer() *analysis.Analyzer {
-	return &analysis.Analyzer{
-		// Optional: normalize punctuation BEFORE tokenizing (e.g., turn periods/commas into spaces)
-		CharFilters: []analysis.CharFilter{
-			char.NewRegexpCharFilter(regexp.MustCompile(`[.,]+`), []byte(" ")),
-		},
-		// Critical: letters-only tokenizer (drops digits/punct)
-		Tokenizer: tokenizer.NewLetterTokenizer(),
-		TokenFilters: []analysis.TokenFilter{
-			en.NewPossessiveFilter(),
-			token.NewLowerCaseFilter(),
-			token.NewStopTokensFilter(en.StopWords()),
-			en.StemmerFilter(),
-			token.NewLengthFilter(2, 40), // tune min/max token length
-		},
+// MakeUnigramDB bins the postings of every vocab word with power-of-d-choices placement: each word's doc list goes into
+// whichever of its config.DChoice candidate bins is the least loaded at the time (in postings, see fillBins). Words are placed longest list first so
+// the big lists get spread out before the bins fill up. Also returns the placement (word -> choice that was used) so it
+// can be published to clients as a hint. Bins that end up bigger than config.Threshold are handled by the overflow
+// policy (see overflow.go), which also decides how the bins are laid out as PIR rows.
+func MakeUnigramDB(postings map[string][]Posting, config globals.Args) ([][]Posting, map[string]uint, binLayout) {
+
+	words := make([]string, 0, len(postings))
+	for word := range postings {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if len(postings[words[i]]) != len(postings[words[j]]) {
+			return len(postings[words[i]]) > len(postings[words[j]])
+		}
+		return words[i] < words[j]
+	})
+
+	// The load of a bin is the number of postings placed in it, an upper bound on the docs it ends up with. Counting
+	// that doesn't need the bins themselves, so placement is one cheap pass and the bins are filled afterwards.
+	load := make([]int, config.BinSize)
+	placement := make(map[string]uint, len(words))
+	binOf := make(map[string]uint, len(words))
+
+	for _, word := range words {
+		candidates := binCandidates(word, config.DChoice, config.BinSize)
+
+		best := 0
+		for d := 1; d < len(candidates); d++ {
+			if load[candidates[d]] < load[candidates[best]] {
+				best = d
+			}
+		}
+		placement[word] = uint(best)
+		binOf[word] = uint(candidates[best])
+		load[candidates[best]] += len(postings[word])
 	}
-}
 
-// TODO: Replace bluge.reader with a generic implements
-func MakeUnigramDB(reader *bluge.Reader, dataset globals.DatasetMetadata, config globals.Args) [][]string {
+	setsBins := fillBins(words, postings, binOf, workerCount(config))
 
-	//tokeniser := en.NewAnalyzer()
+	if config.DebugLevel >= 1 {
+		logPlacementStats(postings, setsBins, config)
+	}
 
-	tokeniser := strictEnglishAnalyzer()
+	binsSlice, layout := applyOverflow(setsBins, config)
 
-	//logrus.Info("Making Unigram Database")
-	//queries, er := LoadQueries(dataset.Queries)
-	//Must(er)
-	//qrels, er := loadQrels(dataset.Qrels)
-	// Must(er)
-	docs, er := LoadCorpus(dataset.OriginalDir)
-	Must(er)
+	if config.DebugLevel >= 1 {
+		logOverflowStats(postings, placement, binsSlice, layout, config)
+	}
 
-	total_items_in_set := 0
+	return binsSlice, placement, layout
 
-	bar := progressbar.Default(int64(len(docs)), fmt.Sprintf("Scanning Vocab for %s", dataset.Name))
+}
 
-	// No sets in go, gotta make my own...
-	set := make(map[string]struct{})
+// fillBins puts the postings of every word in its bin. The bins are sharded over the workers by bin number, so each
+// worker owns its bins and none of them need locking. Very 'hacky' a mapping to a 'set' which is a mapping to globals,
+// converted into regular bins by applyOverflow. The value is the best score the doc got from any word in the bin.
+func fillBins(words []string, postings map[string][]Posting, binOf map[string]uint, workers int) map[uint]map[string]float64 {
+	shards := make([]map[uint]map[string]float64, workers)
+
+	var wg sync.WaitGroup
+	for s := range shards {
+		shards[s] = make(map[uint]map[string]float64)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, word := range words {
+				bin := binOf[word]
+				if int(bin)%workers != s {
+					continue
+				}
+				for _, p := range postings[word] {
+					add(shards[s], bin, p.DocID, p.Score)
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
-	for _, doc := range docs {
+	setsBins := make(map[uint]map[string]float64)
+	for _, shard := range shards {
+		maps.Copy(setsBins, shard)
+	}
+	return setsBins
+}
 
-		title := doc.Title
-		text := doc.Text
-		if text == "" {
-			text = doc.Abstract
+// logPlacementStats compares the max bin size we got against putting every word in its first candidate bin (d = 1).
+func logPlacementStats(postings map[string][]Posting, setsBins map[uint]map[string]float64, config globals.Args) {
+	single := make(map[uint]map[string]float64)
+	for word, hits := range postings {
+		bin := uint(binCandidates(word, 1, config.BinSize)[0])
+		for _, p := range hits {
+			add(single, bin, p.DocID, p.Score)
 		}
+	}
 
-		result := title + " " + text
-
-		tokens := tokeniser.Analyze([]byte(result))
+	singleMax := 0
+	for _, set := range single {
+		singleMax = max(singleMax, len(set))
+	}
+	placedMax := 0
+	for _, set := range setsBins {
+		placedMax = max(placedMax, len(set))
+	}
 
-		for _, t := range tokens {
-			logrus.Tracef("%q term=%q start=%d end=%d posIncr=%d\n",
-				result[t.Start:t.End], t.Term, t.Start, t.End, t.PositionIncr)
-			word := fmt.Sprintf("%s", t.Term)
-			_, ok := set[word]
+	reduction := 0.0
+	if singleMax > 0 {
+		reduction = 100 * float64(singleMax-placedMax) / float64(singleMax)
+	}
+	logrus.Debugf("Max bin size: %d with d=%d choices vs %d with a single choice (%.1f%% smaller)",
+		placedMax, max(config.DChoice, 1), singleMax, reduction)
+}
 
-			if !ok { // item does not exist in set
-				total_items_in_set++
-			}
-			set[word] = struct{}{}
+// binsCSV writes every bin as a row of "docID:score" cells. Empty bins are written as ["", ""] so they survive the
+// round trip (the CSV reader skips blank lines, which would shift every bin after them).
+func binsCSV(binsSlice [][]Posting) [][]string {
+	rows := make([][]string, len(binsSlice))
+	for i, bin := range binsSlice {
+		rows[i] = postingCells(bin)
+		if len(bin) == 0 {
+			rows[i] = []string{"", ""}
 		}
+	}
+	return rows
+}
 
-		bar.Add(1)
+// binsRows is the inverse of binsCSV.
+func binsRows(rows [][]string) ([][]Posting, error) {
+	binsSlice := make([][]Posting, len(rows))
+	for i, row := range rows {
+		bin, err := parsePostingCells(row)
+		if err != nil {
+			return nil, fmt.Errorf("bin %d: %w", i, err)
+		}
+		binsSlice[i] = bin
+	}
+	return binsSlice, nil
+}
 
+func postingCells(bin []Posting) []string {
+	cells := make([]string, len(bin))
+	for i, p := range bin {
+		cells[i] = p.DocID + ":" + strconv.FormatFloat(p.Score, 'g', 8, 64)
 	}
+	return cells
+}
 
-	bar.Finish()
+// parsePostingCells reads "docID:score" cells, skipping blank ones. Cells without a score (DBs saved before scores
+// were kept) get a score of 0.
+func parsePostingCells(cells []string) ([]Posting, error) {
+	var bin []Posting
+	for _, cell := range cells {
+		if cell == "" {
+			continue
+		}
+		sep := strings.LastIndexByte(cell, ':')
+		if sep < 0 {
+			bin = append(bin, Posting{cell, 0})
+			continue
+		}
+		score, err := strconv.ParseFloat(cell[sep+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad posting %q: %w", cell, err)
+		}
+		bin = append(bin, Posting{cell[:sep], score})
+	}
+	return bin, nil
+}
 
-	logrus.Infof("Total items in vocab: %d", total_items_in_set)
+// placementCSV writes the placement hint as [word, choice] rows, sorted by word.
+func placementCSV(placement map[string]uint) [][]string {
+	words := make([]string, 0, len(placement))
+	for word := range placement {
+		words = append(words, word)
+	}
+	sort.Strings(words)
 
-	// Very 'hacky' a mapping to a 'set' which is a mapping to globals. Is converted into a regular bin at the end.
-	setsBins := make(map[uint]map[string]struct{})
+	rows := make([][]string, len(words))
+	for i, word := range words {
+		rows[i] = []string{word, strconv.FormatUint(uint64(placement[word]), 10)}
+	}
+	return rows
+}
 
-	bar = progressbar.Default(int64(len(docs)), fmt.Sprintf("Putting items into bins %s", dataset.Name))
+// placementRows is the inverse of placementCSV.
+func placementRows(rows [][]string) (map[string]uint, error) {
+	placement := make(map[string]uint, len(rows))
+	for i, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("placement row %d has %d fields, want 2", i, len(row))
+		}
+		choice, err := strconv.ParseUint(row[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("placement row %d: %w", i, err)
+		}
+		placement[row[0]] = uint(choice)
+	}
+	return placement, nil
+}
 
-	for word := range set {
+// binCandidates returns the d candidate bins of a word (at least one).
+func binCandidates(word string, d uint, binSize uint) []uint64 {
+	d = max(d, 1)
+	candidates := make([]uint64, d)
+	for i := uint(0); i < d; i++ {
+		candidates[i] = hashTokenChoice(word, i) % uint64(binSize)
+	}
+	return candidates
+}
 
-		bar.Add(1)
-		// Perform BM25 search using each individual word as the Query
+// Posting is a single BM25 hit of a vocab word.
+type Posting struct {
+	DocID string
+	Score float64
+}
 
-		matchTitle := bluge.NewMatchQuery(word).SetField("title")
-		matchBody := bluge.NewMatchQuery(word).SetField("body")
-		boolean := bluge.NewBooleanQuery().
-			AddShould(matchTitle).
-			AddShould(matchBody)
+// MakeUnigramPostings scans the corpus for its vocabulary and then runs a top-K BM25 search for every word. The result
+// maps each word to its hits, best first. Words with too few hits (config.MinHits) are dropped. With config.Ngram > 1
+// the frequent n-grams are searched (as phrases) and returned too, keyed by their joined tokens (see ngram_bins.go).
+// Also returns the doc frequencies of every returned term, which clients use to pick query terms (see query_budget.go).
+// Both the scan and the searches are spread over config.Workers goroutines. config.BinBuilder picks whether the hits
+// come from bluge searches or straight from the postings lists (see postings_bins.go).
+// TODO: Replace bluge.reader with a generic implements
+func MakeUnigramPostings(reader *bluge.Reader, dataset globals.DatasetMetadata, config globals.Args) (map[string][]Posting, termStats) {
 
-		req := bluge.NewTopNSearch(int(config.K), boolean)
-		it, err := reader.Search(context.Background(), req)
+	docFreq, ngramFreq, numDocs := scanVocab(dataset, config)
 
-		var doc_ids []string
+	logrus.Infof("Total items in vocab: %d", len(docFreq))
 
-		for {
-			match, err := it.Next()
-			if err != nil {
-				break
-			}
-			if match == nil { // Should I do something if we have too few items??
-				break
+	if config.Ngram > 1 {
+		kept := 0
+		for gram, freq := range ngramFreq {
+			if freq >= max(config.NgramMinFreq, 1) {
+				docFreq[gram] = freq
+				kept++
 			}
+		}
+		logrus.Infof("Kept %d of %d n-grams (n<=%d) in at least %d docs", kept, len(ngramFreq), config.Ngram,
+			config.NgramMinFreq)
+	}
 
-			// pull out the stored "_id" field instead of match.ID()
-			var docID string
-			err = match.VisitStoredFields(func(field string, value []byte) bool {
-				if field == "_id" {
-					docID = string(value)
-					// storedIDs = append(storedIDs, docID)
-				}
-				return true // keep scanning other stored fields
-			})
-			Must(err)
+	var postings map[string][]Posting
+	stats := termStats{Docs: numDocs, DocFreq: make(map[string]uint, len(docFreq))}
+	search := func(word string) []Posting {
+		return searchTerm(reader, word, config.K)
+	}
 
-			doc_ids = append(doc_ids, docID)
-		}
+	switch config.BinBuilder {
+	case BinBuilderSearch:
+		postings = searchVocab(docFreq, search, dataset.Name, config)
 
-		if len(doc_ids) <= int(config.Threshold) {
-			continue
+	case BinBuilderPostings, BinBuilderCompare:
+		err := withSnapshot(reader, func(snapshot blugesearch.Reader, blugeConfig bluge.Config) error {
+			postings = searchVocab(docFreq, func(word string) []Posting {
+				if isNgram(word) {
+					return search(word)
+				}
+				hits, err := topKPostings(snapshot, blugeConfig, word, config.K)
+				Must(err)
+				return hits
+			}, dataset.Name, config)
+			return nil
+		})
+		Must(err)
+
+		if config.BinBuilder == BinBuilderCompare {
+			fromSearch := searchVocab(docFreq, search, dataset.Name, config)
+			differ := comparePostings(postings, fromSearch)
+			logrus.Infof("Postings and search builders disagree on %d of %d words", differ, len(fromSearch))
+			postings = fromSearch
 		}
 
-		Must(err)
+	default:
+		logrus.Fatalf("Unknown bin builder %q, options are %s|%s|%s", config.BinBuilder, BinBuilderPostings,
+			BinBuilderSearch, BinBuilderCompare)
+	}
 
-		var storedIDs []string
-		// var counter := 0
+	for word := range postings {
+		stats.DocFreq[word] = docFreq[word]
+	}
+	return postings, stats
+}
 
-		for rank := uint(0); rank <= config.K; rank++ {
+// searchVocab gets the hits of every word with search, spread over config.Workers goroutines. Words with too few hits
+// (config.MinHits) are left out.
+func searchVocab(docFreq map[string]uint, search func(word string) []Posting, name string, config globals.Args) map[string][]Posting {
+	postings := make(map[string][]Posting, len(docFreq))
+
+	bar := progressbar.Default(int64(len(docFreq)), fmt.Sprintf("Searching vocab %s", name))
+
+	// The reader is a read only snapshot, so the workers can all search it at once
+	terms := make(chan string, 1024)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range workerCount(config) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for word := range terms {
+				hits := search(word)
+				bar.Add(1)
+				if len(hits) <= int(config.MinHits) {
+					continue
+				}
 
-			if int(rank) >= len(doc_ids) { // Ran out of hits
-				break
+				mu.Lock()
+				postings[word] = hits
+				mu.Unlock()
 			}
-			storedIDs = append(storedIDs, doc_ids[rank])
+		}()
+	}
+	for word := range docFreq {
+		terms <- word
+	}
+	close(terms)
+	wg.Wait()
 
-			// Now to do the actual 'binning' for each unigram.
-			for d := uint(0); d <= config.DChoice; d++ {
+	bar.Finish()
 
-				var bin_index = hashTokenChoice(word, d)
+	return postings
+}
 
-				if !config.Vectors { // If we're just the filenames/raw text
-					for _, docID := range storedIDs {
-						add(setsBins, uint(bin_index)%config.BinSize, docID)
-					}
-				} else {
-					for _, storedID := range storedIDs {
-						add(setsBins, uint(bin_index)%config.BinSize, storedID)
-					}
+// scanVocab streams the corpus through config.Workers tokenisers and counts the docs every word is in. N-grams (with
+// config.Ngram > 1) are counted separately, and the rare ones are pruned as the scan goes (see pruneRare). Also
+// returns the number of docs read.
+func scanVocab(dataset globals.DatasetMetadata, config globals.Args) (map[string]uint, map[string]uint, int) {
+	workers := workerCount(config)
+	docs := make(chan beirDoc, 64*workers)
+	docFreqs := make([]map[string]uint, workers)
+	ngramFreqs := make([]map[string]uint, workers)
+
+	bar := progressbar.Default(-1, fmt.Sprintf("Scanning Vocab for %s", dataset.Name))
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		docFreqs[w] = make(map[string]uint)
+		ngramFreqs[w] = make(map[string]uint)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokeniser := mustAnalyzer(dataset.Analyzer)
+			floor := uint(2) // singletons go first
+			for doc := range docs {
+				countTerms(tokeniser, doc, config.Ngram, docFreqs[w], ngramFreqs[w])
+				if len(ngramFreqs[w]) > ngramScanCap {
+					floor = pruneRare(ngramFreqs[w], floor, ngramScanCap/2)
+					logrus.Debugf("Vocab scan worker %d pruned the n-grams in fewer than %d of its docs", w, floor)
 				}
-
+				bar.Add(1)
 			}
+		}()
+	}
 
-		}
+	report, err := StreamCorpus(dataset.OriginalDir, dataset.Fields, func(d beirDoc) {
+		docs <- d
+	})
+	close(docs)
+	wg.Wait()
+	bar.Finish()
+	Must(err)
 
+	logrus.Infof("Corpus %s: %s", dataset.OriginalDir, report)
+	if report.Loaded < report.Lines {
+		logrus.Warnf("%d corpus lines of %s were skipped", report.Lines-report.Loaded, dataset.Name)
 	}
 
-	bar.Finish()
-	binsSlice := make([][]string, config.BinSize)
+	return mergeCounts(docFreqs), mergeCounts(ngramFreqs), report.Loaded
+}
 
-	for bin, set := range setsBins {
-		idx := int(bin)
+// countTerms adds one to the count of every word (and n-gram up to ngram long) that is in doc.
+func countTerms(tokeniser *analysis.Analyzer, doc beirDoc, ngram uint, docFreq, ngramFreq map[string]uint) {
+	result := doc.Title + " " + doc.Text
+
+	tokens := tokeniser.Analyze([]byte(result))
+	words := make([]string, 0, len(tokens))
+	inDoc := make(map[string]struct{}, len(tokens))
+
+	for _, t := range tokens {
+		logrus.Tracef("%q term=%q start=%d end=%d posIncr=%d\n",
+			result[t.Start:t.End], t.Term, t.Start, t.End, t.PositionIncr)
+		word := string(t.Term)
+		words = append(words, word)
+		if _, ok := inDoc[word]; !ok {
+			inDoc[word] = struct{}{}
+			docFreq[word]++
+		}
+	}
 
-		// Pre-size capacity to avoid re-allocs while appending
-		binsSlice[idx] = make([]string, 0, len(set))
-		for w := range set {
-			binsSlice[idx] = append(binsSlice[idx], w)
+	for _, gram := range ngramTerms(words, ngram) {
+		if _, ok := inDoc[gram]; !ok {
+			inDoc[gram] = struct{}{}
+			ngramFreq[gram]++
 		}
+	}
+}
 
+// mergeCounts sums the per worker counts into the first one.
+func mergeCounts(counts []map[string]uint) map[string]uint {
+	merged := counts[0]
+	for _, c := range counts[1:] {
+		for term, n := range c {
+			merged[term] += n
+		}
 	}
+	return merged
+}
+
+// searchTerm is the top-k BM25 search of one word (or n-gram phrase) over the title and body.
+func searchTerm(reader *bluge.Reader, word string, k uint) []Posting {
+	matchTitle := termQuery(word, "title")
+	matchBody := termQuery(word, "body")
+	boolean := bluge.NewBooleanQuery().
+		AddShould(matchTitle).
+		AddShould(matchBody)
+
+	req := bluge.NewTopNSearch(int(k), boolean)
+	it, err := reader.Search(context.Background(), req)
+	Must(err)
 
-	return binsSlice
+	var hits []Posting
 
+	for {
+		match, err := it.Next()
+		if err != nil {
+			break
+		}
+		if match == nil { // Should I do something if we have too few items??
+			break
+		}
+
+		// pull out the stored "_id" field instead of match.ID()
+		var docID string
+		err = match.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				docID = string(value)
+			}
+			return true // keep scanning other stored fields
+		})
+		Must(err)
+
+		hits = append(hits, Posting{docID, match.Score})
+	}
+	return hits
 }
 
-func add(sets map[uint]map[string]struct{}, bin uint, word string) {
+// workerCount is config.Workers, or one per CPU if it isn't set.
+func workerCount(config globals.Args) int {
+	if config.Workers == 0 {
+		return runtime.NumCPU()
+	}
+	return int(config.Workers)
+}
+
+func add(sets map[uint]map[string]float64, bin uint, word string, score float64) {
 	if sets[bin] == nil {
-		sets[bin] = make(map[string]struct{})
+		sets[bin] = make(map[string]float64)
+	}
+	if old, ok := sets[bin][word]; !ok || score > old {
+		sets[bin][word] = score
 	}
-	sets[bin][word] = struct{}{}
 }
 
 func hashTokenChoice(tokens string, i uint) uint64 {
@@ -0,0 +1,122 @@
+package bins
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	"github.com/dkblackley/bins-go/globals"
+)
+
+func TestScanVocabWorkers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corpus.jsonl")
+	var corpus []byte
+	for i := range 200 {
+		line := fmt.Sprintf(`{"_id": "d%d", "title": "private search", "text": "bins number %c hold documents"}`+"\n",
+			i, 'a'+i%26)
+		corpus = append(corpus, line...)
+	}
+	if err := os.WriteFile(path, corpus, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dataset := globals.DatasetMetadata{Name: "test", OriginalDir: path}
+	config := globals.Args{Ngram: 2, Workers: 1}
+	wantFreq, wantNgrams, wantDocs := scanVocab(dataset, config)
+
+	config.Workers = 4
+	docFreq, ngramFreq, docs := scanVocab(dataset, config)
+	if docs != 200 || wantDocs != 200 {
+		t.Errorf("read %d and %d docs, want 200", wantDocs, docs)
+	}
+	if !maps.Equal(docFreq, wantFreq) || !maps.Equal(ngramFreq, wantNgrams) {
+		t.Errorf("4 workers counted %v %v, one worker %v %v", docFreq, ngramFreq, wantFreq, wantNgrams)
+	}
+	if docFreq["privat"] != 200 {
+		t.Errorf("got doc frequency %d for privat, want 200", docFreq["privat"])
+	}
+}
+
+func TestPruneRare(t *testing.T) {
+	counts := map[string]uint{"a b": 1, "b c": 1, "c d": 2, "d e": 3, "e f": 5}
+
+	floor := pruneRare(counts, 2, 4)
+	if want := map[string]uint{"c d": 2, "d e": 3, "e f": 5}; floor != 2 || !maps.Equal(counts, want) {
+		t.Errorf("pruned singletons to %v (floor %d), want %v", counts, floor, want)
+	}
+	floor = pruneRare(counts, floor, 1)
+	if want := map[string]uint{"e f": 5}; floor != 4 || !maps.Equal(counts, want) {
+		t.Errorf("pruned down to %v (floor %d), want %v", counts, floor, want)
+	}
+}
+
+func TestMakeUnigramDBWorkers(t *testing.T) {
+	postings := make(map[string][]Posting)
+	for w := range 50 {
+		var hits []Posting
+		for d := range w%7 + 1 {
+			hits = append(hits, Posting{fmt.Sprintf("d%d", (w*3+d)%40), float64(d)})
+		}
+		postings[fmt.Sprintf("word%d", w)] = hits
+	}
+
+	config := globals.Args{BinSize: 8, DChoice: 2, Workers: 1, DebugLevel: -1}
+	wantBins, wantPlacement, _ := MakeUnigramDB(postings, config)
+
+	config.Workers = 3
+	gotBins, gotPlacement, _ := MakeUnigramDB(postings, config)
+	if !reflect.DeepEqual(gotBins, wantBins) || !maps.Equal(gotPlacement, wantPlacement) {
+		t.Errorf("sharded bins differ from one worker:\n%v\n%v", gotBins, wantBins)
+	}
+}
+
+func TestPostingsMatchSearch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corpus.jsonl")
+	var corpus []byte
+	words := []string{"private", "search", "bins", "query", "index", "heap"}
+	for i := range 300 {
+		// Docs of different lengths, with plenty of exact ties between them
+		text := ""
+		for j := range i%9 + 1 {
+			text += words[(i+j*j)%len(words)] + " "
+		}
+		line := fmt.Sprintf(`{"_id": "d%d", "title": "%s", "text": "%s"}`+"\n", i, words[i%4], text)
+		corpus = append(corpus, line...)
+	}
+	if err := os.WriteFile(path, corpus, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := BuildBlugeIndexFromJSONL(path, filepath.Join(dir, "index"), globals.CorpusFields{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(filepath.Join(dir, "index")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	err = withSnapshot(reader, func(snapshot search.Reader, config bluge.Config) error {
+		for _, k := range []uint{1, 7, 500} {
+			for _, word := range append(words, "missing") {
+				got, err := topKPostings(snapshot, config, word, k)
+				if err != nil {
+					return err
+				}
+				want := searchTerm(reader, word, k)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("k=%d %q: postings got %v, search got %v", k, word, got, want)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+// The experiments are split into stages, one subcommand each. A stage reads the artifacts of the stages before it and
+// writes its own, so every stage can be cached, rerun on its own and scheduled as its own Slurm job:
+//
+//	index        corpus                 -> the bluge index and its bins_index.json, in the dataset's index dir
+//	build-bins   index                  -> <name>_<unigram|ngramN|keyword>_k<k>_DB.csv, _placement.csv, _docfreq.csv
+//	build-graph  corpus vectors         -> the dataset's graph .npy
+//	preprocess   bins and/or graph      -> <t>_<k>.pirstate, the PIR client state, in the run directory
+//	search       the same and .pirstate -> <t>_<k>.answers, the encoded answers, and the online costs
+//	decode       <t>_<k>.answers        -> -outFile, the doc IDs (re-ranked against the query vectors with -rerank)
+//	rerank       -run answers           -> -outFile, the answers re-ranked with BM25 over their docs
+//	eval         -run answers           -> <t>_<k>.run and <t>_<k>.eval in the run directory
+//	fuse         -fuse answers          -> -outFile, the fused answers, and their evaluation
+//	compare      -compare answers       -> compare_<k>.txt in the run directory
+//
+// preprocess runs the offline phase and saves the hints the client ends up with, search loads them (from -pirState, or
+// the latest preprocess run of its -name, -t and -k) instead of running the offline phase again. search saves a
+// checkpoint to -checkpoint every so many queries, and search -load carries on after the last one. The .pirstate and
+// the checkpoints hold the client's secret PIR keys, whoever reads them can tell what was queried: they are only
+// readable by their owner and must not be shared like the other outputs. Every run of a stage gets a fresh directory,
+// runs/<stage>_<name>_..., next to its main output and writes a manifest.json there with its config, the digests of
+// what it read and wrote and what it measured.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dkblackley/bins-go/bins"
+	"github.com/dkblackley/bins-go/bins/rerank"
+	"github.com/dkblackley/bins-go/fusion"
+	"github.com/dkblackley/bins-go/globals"
+	"github.com/sirupsen/logrus"
+)
+
+// options are the flags that aren't part of globals.Args.
+type options struct {
+	datasetConfig  string
+	answers        string // encoded answers written by search and read by decode, see answersFile
+	pirState       string // PIR client state written by preprocess and read by search, see pirStateFile
+	run            string // answers file read by rerank and eval
+	fuseFiles      string
+	fuseMethod     string
+	fuseWeights    string
+	compareFiles   string
+	compareMetrics string
+}
+
+// flagGroup registers a group of flags that several commands share.
+type flagGroup func(fs *flag.FlagSet, config *globals.Args, o *options)
+
+type command struct {
+	name    string
+	summary string
+	flags   []flagGroup
+	files   func(config globals.Args) []string           // dataset files the command can't run without
+	runsIn  func(config globals.Args, o *options) string // where the runs directory goes, next to the main output
+	run     func(config globals.Args, o *options)
+}
+
+// requiredFiles are the dataset files each search type can't run without. The graph isn't required, Pacmann builds it
+// if it is missing. The bins come from build-bins.
+var requiredFiles = map[string][]string{
+	"bins":    {globals.FileQueries, globals.FileQrels, globals.FileCorpusVec},
+	"pacmann": {globals.FileCorpus, globals.FileQueries, globals.FileQrels, globals.FileCorpusVec, globals.FileQueryVec},
+	"hybrid":  {globals.FileQueries, globals.FileQrels, globals.FileCorpusVec, globals.FileQueryVec},
+}
+
+func searchFiles(config globals.Args) []string {
+	return requiredFiles[config.SearchType]
+}
+
+func files(names ...string) func(globals.Args) []string {
+	return func(globals.Args) []string { return names }
+}
+
+func workingDir(globals.Args, *options) string { return "." }
+
+func outFileDir(config globals.Args, o *options) string { return filepath.Dir(config.OutFile) }
+
+var commands = []command{
+	{
+		name:    "index",
+		summary: "build the bluge index of the corpus the bins are searched from",
+		flags:   []flagGroup{datasetFlags},
+		files:   files(globals.FileCorpus),
+		runsIn:  func(config globals.Args, o *options) string { return filepath.Dir(config.DatasetMeta.IndexDir) },
+		run:     runIndex,
+	},
+	{
+		name:    "build-bins",
+		summary: "build the bins from the index and save them",
+		flags:   []flagGroup{datasetFlags, kFlag, binsFlags, buildBinsFlags},
+		files:   files(globals.FileIndex, globals.FileCorpus),
+		runsIn:  workingDir,
+		run:     runBuildBins,
+	},
+	{
+		name:    "build-graph",
+		summary: "build the Pacmann graph of the corpus vectors and save it",
+		flags:   []flagGroup{datasetFlags, vectorFlags, seedFlag},
+		files:   files(globals.FileCorpusVec),
+		runsIn: func(config globals.Args, o *options) string {
+			return filepath.Dir(config.DatasetMeta.Vectors.CorpusVec)
+		},
+		run: runBuildGraph,
+	},
+	{
+		name:    "preprocess",
+		summary: "set up the PIR of -t, run its offline phase and save the PIR client state for search",
+		flags:   []flagGroup{datasetFlags, typeFlags, vectorFlags, binsFlags, searchFlags, seedFlag},
+		files:   searchFiles,
+		runsIn:  workingDir,
+		run:     runPreprocess,
+	},
+	{
+		name:    "search",
+		summary: "answer every query through the PIR of -t and save the encoded answers",
+		flags:   []flagGroup{datasetFlags, typeFlags, vectorFlags, binsFlags, searchFlags, answersFlag, pirStateFlag, seedFlag, checkpointFlags},
+		files:   searchFiles,
+		runsIn:  func(config globals.Args, o *options) string { return filepath.Dir(answersFile(config, o)) },
+		run:     runSearch,
+	},
+	{
+		name:    "decode",
+		summary: "decode the answers saved by search into doc IDs",
+		flags:   []flagGroup{datasetFlags, typeFlags, answersFlag, rerankFlag, outputFlags},
+		files: func(config globals.Args) []string {
+			if config.ReRank != rerank.MetricNone {
+				return []string{globals.FileQrels, globals.FileQueryVec}
+			}
+			return []string{globals.FileQrels}
+		},
+		runsIn: outFileDir,
+		run:    runDecode,
+	},
+	{
+		name:    "rerank",
+		summary: "re-rank the docs of an answers file with BM25",
+		flags:   []flagGroup{datasetFlags, typeFlags, runFlag, outputFlags},
+		files:   files(globals.FileCorpus, globals.FileQueries, globals.FileQrels),
+		runsIn:  outFileDir,
+		run:     runRerank,
+	},
+	{
+		name:    "eval",
+		summary: "evaluate an answers file against the qrels",
+		flags:   []flagGroup{datasetFlags, typeFlags, runFlag},
+		files:   files(globals.FileQrels),
+		runsIn:  func(config globals.Args, o *options) string { return filepath.Dir(o.run) },
+		run:     runEval,
+	},
+	{
+		name:    "fuse",
+		summary: "fuse the answer files of earlier runs (no PIR)",
+		flags:   []flagGroup{datasetFlags, kFlag, fuseFlags, outputFlags},
+		files:   files(globals.FileQrels),
+		runsIn:  outFileDir,
+		run:     runFuse,
+	},
+	{
+		name:    "compare",
+		summary: "significance tests between the answer files of earlier runs",
+		flags:   []flagGroup{datasetFlags, kFlag, compareFlags, seedFlag},
+		files:   files(globals.FileQrels),
+		runsIn:  workingDir,
+		run:     runCompare,
+	},
+}
+
+func datasetFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&config.DataName, "name", "msmarco", "Identifier for the dataset to be loaded")
+	fs.StringVar(&config.DatasetsDirectory, "dataset", "../datasets", "Where to look for the dataset/data")
+	fs.StringVar(&o.datasetConfig, "datasetConfig", "", "JSON dataset registry (see globals/datasets.go), default the built in msmarco|scifact|trec-covid|debug")
+	fs.IntVar(&config.DebugLevel, "debug", 1, "Debug level, 0 for info, 1 for debug, 2 for trace and -1 for no debug")
+}
+
+func kFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.UintVar(&config.K, "k", 5, "K many items to return in search")
+}
+
+// typeFlags name the run, every stage after build-* reads and writes <t>_<k>_* files.
+func typeFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&config.SearchType, "t", "bins", "Search type, current options are 'bins'|'pacmann'|'hybrid' (bins seed the graph walk)")
+	kFlag(fs, config, o)
+}
+
+func vectorFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.UintVar(&config.DBSize, "n", 8841823, "Number of items/vectors in DB")
+	fs.UintVar(&config.Dimensions, "dim", 192, "Dimension of vectors (if being used)")
+	fs.BoolVar(&config.Vectors, "vectors", true, "Use npy vectors for retrieval or raw text")
+}
+
+// binsFlags decide the layout of the bins, build-bins and the stages that load them have to agree on them (and on -k).
+func binsFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.UintVar(&config.BinSize, "binSize", 8841823/100, "The number of bins to use")
+	fs.UintVar(&config.Threshold, "thresh", 0, "Max docs per bin, bigger bins are handled by -overflow (0 for no cap)")
+	fs.StringVar(&config.Overflow, "overflow", "drop", "Policy for bins over -thresh: 'drop' lowest scored|'spill' into overflow bins|'split' over several entries")
+	fs.UintVar(&config.OverflowBins, "overflowBins", 0, "Number of overflow bins for -overflow spill (0 for binSize/10)")
+	fs.UintVar(&config.DChoice, "d", 1, "Number of candidate bins per token, each token goes in the least loaded one")
+	fs.BoolVar(&config.PlacementHint, "placementHint", false, "Publish which candidate bin each token went to, so clients query one bin per token instead of d")
+	fs.UintVar(&config.Ngram, "ngram", 1, "Also bin n-grams up to this length (1 for unigrams only)")
+	fs.BoolVar(&config.KeywordPIR, "keyword", false, "Query bins by token (cuckoo hashed, tagged entries) instead of by bin index")
+}
+
+func buildBinsFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.UintVar(&config.MinHits, "minHits", 0, "Leave out words with this many BM25 hits or fewer")
+	fs.UintVar(&config.NgramMinFreq, "ngramMinFreq", 5, "Only bin n-grams that are in at least this many docs")
+	fs.StringVar(&config.BinBuilder, "binBuilder", bins.BinBuilderPostings, "Where each word's BM25 hits come from: 'postings' walk the index postings lists|'search' one top-K search per word|'compare' both, logging the words they disagree on")
+	fs.UintVar(&config.Workers, "workers", 0, "Goroutines for scanning the corpus, searching the vocab and filling the bins (0 for one per CPU)")
+}
+
+func searchFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.UintVar(&config.BatchSize, "batch", 32, "PIR indices per query, queries are padded with dummies or cut down to exactly this many (0: every term, unpadded)")
+	fs.StringVar(&config.TokenPolicy, "tokenPolicy", "idf", "Which query tokens to keep when they don't fit in -batch: 'idf' rarest first|'stopword' drop common tokens first|'first' query order")
+	fs.BoolVar(&config.Private, "private", true, "Fetch through PIR, -private=false reads the DB in plaintext (the no-privacy baseline)")
+	fs.BoolVar(&config.DiffPrivate, "diffPrivate", false, "Also answer every query in plaintext and count the PIR answers that differ (search only)")
+	fs.UintVar(&config.RTT, "RTT", 50, "RTT for the network")
+}
+
+// seedFlag is for the stages that draw random numbers: the padding of the PIR batches, the graph and its random
+// vertices and the resampling of compare. The PIR keys and dummy queries come from crypto/rand, never from it.
+func seedFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.Int64Var(&config.Seed, "seed", 0, "Seed of every (non-cryptographic) random source, 0 picks one from the clock (it is logged and in the manifest, so the PIR keys never come from it)")
+}
+
+// checkpointFlags let a search that was cut off (a Slurm time limit) carry on where it was instead of starting over.
+func checkpointFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&config.CheckPointFolder, "checkpoint", "checkPoint", "Where to save the checkpoints and look for them with -load")
+	fs.UintVar(&config.CheckPointEvery, "checkpointEvery", 500, "Save a checkpoint every this many queries (0 for never)")
+	fs.BoolVar(&config.Resume, "load", false, "Resume from the checkpoint of this -name, -t and -k in -checkpoint, after its last answered query")
+}
+
+func answersFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&o.answers, "answers", "", "Encoded answers written by search and read by decode (default <t>_<k>.answers)")
+}
+
+func pirStateFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&o.pirState, "pirState", "", "PIR client state saved by preprocess (default the one of the latest preprocess run of this -name, -t and -k)")
+}
+
+func rerankFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&config.ReRank, "rerank", rerank.MetricNone, "Re-rank the bins results against the query vectors while decoding: 'none'|'ip' inner product|'l2' distance")
+}
+
+func runFlag(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&o.run, "run", "", "Answers file to read (-outFile of decode, rerank or fuse, json, trec or tsv)")
+}
+
+func outputFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&config.OutFile, "outFile", "out.json", "Where to save the answers")
+	fs.StringVar(&config.OutFormat, "outFormat", "json", "Format of -outFile: 'json' qid -> doc IDs|'trec' run file (qid Q0 docid rank score tag)|'tsv' qid docid rank [score]")
+}
+
+func fuseFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&o.fuseFiles, "fuse", "", "Comma separated answer files (-outFile of earlier runs, json, trec or tsv) to fuse")
+	fs.StringVar(&o.fuseMethod, "fusion", fusion.MethodRRF, "How to fuse: 'rrf'|'combsum'|'combmnz'|'linear'")
+	fs.StringVar(&o.fuseWeights, "fuseWeights", "", "Comma separated weights of the -fuse files for -fusion linear (default all 1)")
+}
+
+func compareFlags(fs *flag.FlagSet, config *globals.Args, o *options) {
+	fs.StringVar(&o.compareFiles, "compare", "", "Comma separated answer files (json, trec or tsv) to compare, the first is the baseline")
+	fs.StringVar(&o.compareMetrics, "compareMetrics", "", "Comma separated metrics to compare on, e.g. 'ndcg@10,mrr@10' (default all of them)")
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+// parseFlags parses the flags of cmd, resolves the dataset, sets up logging and checks the dataset has the files cmd
+// needs.
+func parseFlags(cmd command, arguments []string) (globals.Args, *options) {
+	config := globals.Args{}
+	o := &options{}
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	for _, group := range cmd.flags {
+		group(fs, &config, o)
+	}
+	fs.Parse(arguments)
+
+	if cmd.name == "fuse" || cmd.name == "compare" {
+		config.SearchType = cmd.name
+	}
+	config.Private = config.Private || config.DiffPrivate
+
+	registry := globals.DefaultDatasets()
+	if o.datasetConfig != "" {
+		var err error
+		registry, err = globals.LoadDatasetRegistry(o.datasetConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	meta, err := registry.Resolve(config.DatasetsDirectory, config.DataName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.DatasetMeta = meta
+
+	// The dataset knows its dimension, an explicit -dim still wins
+	dimSet := false
+	fs.Visit(func(f *flag.Flag) {
+		dimSet = dimSet || f.Name == "dim"
+	})
+	if !dimSet && meta.Dimensions != 0 {
+		config.Dimensions = meta.Dimensions
+	}
+
+	switch config.DebugLevel {
+	case 0:
+		logrus.SetLevel(logrus.InfoLevel)
+	case 1:
+		logrus.SetLevel(logrus.DebugLevel)
+	case 2:
+		logrus.SetLevel(logrus.TraceLevel)
+	default:
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+	logrus.SetReportCaller(true)
+
+	logrus.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	if fs.Lookup("seed") != nil {
+		if config.Seed == 0 {
+			config.Seed = time.Now().UnixNano()
+		}
+		logrus.Infof("Seed: %d", config.Seed)
+	}
+
+	logrus.Debugf("%s config: %v", cmd.name, config)
+
+	if err := meta.Validate(cmd.files(config)...); err != nil {
+		logrus.Fatal(err)
+	}
+	if _, err := bins.NewAnalyzer(meta.Analyzer); err != nil {
+		logrus.Fatalf("Dataset %s: %v", meta.Name, err)
+	}
+	if config.OutFormat != "" && config.OutFormat != "json" && config.OutFormat != "trec" && config.OutFormat != "tsv" {
+		logrus.Fatalf("Invalid -outFormat: %s", config.OutFormat)
+	}
+
+	return config, o
+}
+
+// startRun makes the run directory of cmd and starts its manifest with the dataset files cmd reads.
+func startRun(cmd command, config *globals.Args, o *options) {
+	name := cmd.name + "_" + config.DataName
+	if config.SearchType != "" {
+		name += fmt.Sprintf("_%s_%d", config.SearchType, config.K)
+	}
+	dir, err := globals.NewRunDir(cmd.runsIn(*config, o), name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.RunDir = dir
+	config.Manifest = globals.NewManifest(cmd.name, *config)
+	for _, file := range cmd.files(*config) {
+		path := config.DatasetMeta.Path(file)
+		if file == globals.FileIndex { // A directory, the metadata BuildIndex left in it says what it was built from
+			path = filepath.Join(path, bins.IndexMetadataFile)
+		}
+		addInputs(*config, path)
+	}
+	logrus.Infof("Run directory: %s", dir)
+}
+
+// finishRun writes the manifest of the run to its run directory.
+func finishRun(config globals.Args) {
+	config.Manifest.Config = config
+	path, err := config.Manifest.Write(config.RunDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logrus.Infof("Wrote the manifest to %s", path)
+}
+
+func addInputs(config globals.Args, paths ...string) {
+	for _, path := range paths {
+		if err := config.Manifest.AddInput(path); err != nil {
+			logrus.Warnf("Not in the manifest: %v", err)
+		}
+	}
+}
+
+func addOutputs(config globals.Args, paths ...string) {
+	for _, path := range paths {
+		if err := config.Manifest.AddOutput(path); err != nil {
+			logrus.Warnf("Not in the manifest: %v", err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package eval scores rankings against (graded) qrels: nDCG@k, Recall@k, Precision@k, MAP, MRR, MRR@k and success@k, per
+// query and averaged, and reads/writes TREC style run and eval files so results line up with trec_eval.
+//
+// A query is evaluated if it is in the run and has at least one relevant (grade > 0) doc in the qrels. Queries with
+// qrels that are missing from the run are not counted, the number of them is in the Report so it can be checked.
+package eval
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Qrels maps QID -> doc ID -> relevance grade. Only grades > 0 are kept.
+type Qrels map[string]map[string]int
+
+// LoadQrels reads BEIR style "qid docid grade" qrels (with or without the header line) or TREC style
+// "qid iteration docid grade" qrels.
+func LoadQrels(path string) (Qrels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rels := make(Qrels)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.Fields(sc.Text())
+		var qid, docID, grade string
+		switch len(line) {
+		case 3:
+			qid, docID, grade = line[0], line[1], line[2]
+		case 4:
+			qid, docID, grade = line[0], line[2], line[3]
+		default:
+			continue
+		}
+
+		g, err := strconv.Atoi(grade)
+		if err != nil || g <= 0 { // the header, or not relevant
+			continue
+		}
+		if _, ok := rels[qid]; !ok {
+			rels[qid] = make(map[string]int)
+		}
+		rels[qid][docID] = g
+	}
+	return rels, sc.Err()
+}
+
+// Report is the evaluation of one run.
+type Report struct {
+	Metrics  []string                      // metric names, in the order they are printed
+	PerQuery map[string]map[string]float64 // QID -> metric -> value
+	Mean     map[string]float64            // metric -> mean over the evaluated queries
+	Missing  int                           // queries with qrels that are not in the run
+}
+
+// MetricNames are the metrics Evaluate computes for the cutoffs ks.
+func MetricNames(ks []int) []string {
+	names := []string{"map", "recip_rank"}
+	for _, k := range ks {
+		names = append(names,
+			fmt.Sprintf("ndcg@%d", k),
+			fmt.Sprintf("recall@%d", k),
+			fmt.Sprintf("P@%d", k),
+			fmt.Sprintf("mrr@%d", k),
+			fmt.Sprintf("success@%d", k))
+	}
+	return names
+}
+
+// Evaluate scores run (QID -> doc IDs, best first) at every cutoff in ks. Repeats of a doc in a ranking are ignored.
+func Evaluate(rels Qrels, run map[string][]string, ks []int) Report {
+	report := Report{
+		Metrics:  MetricNames(ks),
+		PerQuery: make(map[string]map[string]float64),
+		Mean:     make(map[string]float64),
+	}
+
+	for qid, relevant := range rels {
+		docs, ok := run[qid]
+		if !ok {
+			report.Missing++
+			continue
+		}
+		report.PerQuery[qid] = evaluateQuery(relevant, dedupe(docs), ks)
+	}
+
+	if len(report.PerQuery) == 0 {
+		return report
+	}
+	for _, metrics := range report.PerQuery {
+		for name, value := range metrics {
+			report.Mean[name] += value
+		}
+	}
+	for name := range report.Mean {
+		report.Mean[name] /= float64(len(report.PerQuery))
+	}
+	return report
+}
+
+// CandidateRecall is the fraction of the relevant docs (over every query of candidates with qrels) that are among its
+// candidates, in whatever order. It is meant for every doc a run fetched, before they are cut to k or re-ranked:
+// compare it between runs to see what a change to what gets fetched (e.g. -ngram) does to recall.
+func CandidateRecall(rels Qrels, candidates map[string][]string) (float64, error) {
+	found, total := 0, 0
+	for qid, docs := range candidates {
+		relevant := rels[qid]
+		total += len(relevant)
+		for _, docID := range dedupe(docs) {
+			if relevant[docID] > 0 {
+				found++
+			}
+		}
+	}
+
+	if total == 0 {
+		return 0, errors.New("none of the queries have qrels")
+	}
+	return float64(found) / float64(total), nil
+}
+
+// QIDs are the evaluated queries, sorted.
+func (r Report) QIDs() []string {
+	qids := make([]string, 0, len(r.PerQuery))
+	for qid := range r.PerQuery {
+		qids = append(qids, qid)
+	}
+	sort.Strings(qids)
+	return qids
+}
+
+// String is the mean of every metric, one per line.
+func (r Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d queries evaluated, %d with qrels missing from the run\n", len(r.PerQuery), r.Missing)
+	for _, name := range r.Metrics {
+		fmt.Fprintf(&sb, "%-12s %.4f\n", name, r.Mean[name])
+	}
+	return sb.String()
+}
+
+func evaluateQuery(relevant map[string]int, docs []string, ks []int) map[string]float64 {
+	metrics := make(map[string]float64, 2+5*len(ks))
+
+	// AP and RR over the whole ranking
+	hits := 0
+	var sumPrec float64
+	metrics["recip_rank"] = 0
+	for i, docID := range docs {
+		if relevant[docID] > 0 {
+			hits++
+			sumPrec += float64(hits) / float64(i+1)
+			if hits == 1 {
+				metrics["recip_rank"] = 1 / float64(i+1)
+			}
+		}
+	}
+	metrics["map"] = sumPrec / float64(len(relevant))
+
+	for _, k := range ks {
+		top := docs[:min(k, len(docs))]
+
+		hits, firstHit := 0, 0
+		for i, docID := range top {
+			if relevant[docID] > 0 {
+				hits++
+				if firstHit == 0 {
+					firstHit = i + 1
+				}
+			}
+		}
+
+		metrics[fmt.Sprintf("ndcg@%d", k)] = ndcg(relevant, top, k)
+		metrics[fmt.Sprintf("recall@%d", k)] = float64(hits) / float64(len(relevant))
+		metrics[fmt.Sprintf("P@%d", k)] = float64(hits) / float64(k)
+		metrics[fmt.Sprintf("mrr@%d", k)] = 0
+		metrics[fmt.Sprintf("success@%d", k)] = 0
+		if firstHit > 0 {
+			metrics[fmt.Sprintf("mrr@%d", k)] = 1 / float64(firstHit)
+			metrics[fmt.Sprintf("success@%d", k)] = 1
+		}
+	}
+	return metrics
+}
+
+// ndcg uses the grade as the gain (as trec_eval does) and a log2(rank+1) discount.
+func ndcg(relevant map[string]int, top []string, k int) float64 {
+	var dcg float64
+	for i, docID := range top {
+		dcg += float64(relevant[docID]) / math.Log2(float64(i+2))
+	}
+
+	grades := make([]int, 0, len(relevant))
+	for _, g := range relevant {
+		grades = append(grades, g)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+
+	var idcg float64
+	for i, g := range grades[:min(k, len(grades))] {
+		idcg += float64(g) / math.Log2(float64(i+2))
+	}
+	if idcg == 0 {
+		return 0
+	}
+	return dcg / idcg
+}
+
+func dedupe(docs []string) []string {
+	seen := make(map[string]struct{}, len(docs))
+	out := make([]string, 0, len(docs))
+	for _, docID := range docs {
+		if _, ok := seen[docID]; ok {
+			continue
+		}
+		seen[docID] = struct{}{}
+		out = append(out, docID)
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package eval
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestEvaluate(t *testing.T) {
+	rels := Qrels{
+		"q":  {"a": 2, "b": 1},
+		"q2": {"x": 1},
+		"q3": {"y": 1}, // not in the run
+	}
+	run := map[string][]string{
+		"q":  {"c", "a", "a", "b"}, // the repeated a is ignored
+		"q2": {},
+		"q4": {"z"}, // no qrels
+	}
+
+	report := Evaluate(rels, run, []int{2})
+	if len(report.PerQuery) != 2 || report.Missing != 1 {
+		t.Fatalf("evaluated %d queries with %d missing, want 2 and 1", len(report.PerQuery), report.Missing)
+	}
+
+	want := map[string]float64{
+		"map":        (1.0/2 + 2.0/3) / 2,
+		"recip_rank": 0.5,
+		"ndcg@2":     (2 / math.Log2(3)) / (2 + 1/math.Log2(3)),
+		"recall@2":   0.5,
+		"P@2":        0.5,
+		"mrr@2":      0.5,
+		"success@2":  1,
+	}
+	for name, value := range want {
+		if got := report.PerQuery["q"][name]; !near(got, value) {
+			t.Errorf("q %s = %f, want %f", name, got, value)
+		}
+		if got := report.PerQuery["q2"][name]; got != 0 {
+			t.Errorf("q2 %s = %f, want 0", name, got)
+		}
+		if got := report.Mean[name]; !near(got, value/2) {
+			t.Errorf("mean %s = %f, want %f", name, got, value/2)
+		}
+	}
+}
+
+func TestCandidateRecall(t *testing.T) {
+	rels := Qrels{"q": {"a": 2, "b": 1}, "q2": {"x": 1}}
+	candidates := map[string][]string{
+		"q":  {"c", "b", "b"}, // the repeated b is counted once
+		"q2": {"x"},
+		"q4": {"z"}, // no qrels
+	}
+	if got, err := CandidateRecall(rels, candidates); err != nil || !near(got, 2.0/3) {
+		t.Errorf("got %f, %v, want %f", got, err, 2.0/3)
+	}
+	if _, err := CandidateRecall(Qrels{}, candidates); err == nil {
+		t.Error("no error without qrels")
+	}
+}
+
+func TestLoadQrels(t *testing.T) {
+	dir := t.TempDir()
+	beir := filepath.Join(dir, "beir.tsv")
+	trec := filepath.Join(dir, "trec.txt")
+	if err := os.WriteFile(beir, []byte("query-id\tcorpus-id\tscore\nq\ta\t2\nq\tb\t0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(trec, []byte("q 0 a 2\nq 0 b 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{beir, trec} {
+		rels, err := LoadQrels(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rels) != 1 || len(rels["q"]) != 1 || rels["q"]["a"] != 2 {
+			t.Errorf("%s: got %v, want map[q:map[a:2]]", path, rels)
+		}
+	}
+}
+
+func TestRunRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.run")
+	run := map[string][]string{"q": {"b", "a"}, "q2": {"c"}}
+
+	if err := WriteRun(path, run, map[string][]float64{"q": {0.5, 0.25}}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	docs, scores, err := LoadRun(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(docs["q"], run["q"]) || !slices.Equal(docs["q2"], run["q2"]) {
+		t.Errorf("got %v, want %v", docs, run)
+	}
+	if !slices.Equal(scores["q"], []float64{0.5, 0.25}) || !slices.Equal(scores["q2"], []float64{1}) {
+		t.Errorf("got scores %v", scores)
+	}
+}
+
+func TestWriteEval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.eval")
+	report := Evaluate(Qrels{"q": {"a": 1}}, map[string][]string{"q": {"b", "a"}}, []int{10})
+	if err := WriteEval(path, report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Under trec_eval's names, mrr@10 has none
+	want := "map\tq\t0.5000\nrecip_rank\tq\t0.5000\nndcg_cut_10\tq\t0.6309\nrecall_10\tq\t1.0000\nP_10\tq\t0.1000\n" +
+		"success_10\tq\t1.0000\nnum_q\tall\t1\nmap\tall\t0.5000\nrecip_rank\tall\t0.5000\nndcg_cut_10\tall\t0.6309\n" +
+		"recall_10\tall\t1.0000\nP_10\tall\t0.1000\nsuccess_10\tall\t1.0000\n"
+	if string(data) != want {
+		t.Errorf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestLoadTSVRun(t *testing.T) {
+	dir := t.TempDir()
+	run := map[string][]string{"q": {"b", "a"}, "q2": {"c"}}
+
+	scored := filepath.Join(dir, "scored.tsv")
+	if err := WriteTSV(scored, run, map[string][]float64{"q": {0.5, 0.25}, "q2": {2}}); err != nil {
+		t.Fatal(err)
+	}
+	docs, scores, err := LoadRun(scored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(docs["q"], run["q"]) || !slices.Equal(docs["q2"], run["q2"]) {
+		t.Errorf("got %v, want %v", docs, run)
+	}
+	if !slices.Equal(scores["q"], []float64{0.5, 0.25}) || !slices.Equal(scores["q2"], []float64{2}) {
+		t.Errorf("got scores %v", scores)
+	}
+
+	unscored := filepath.Join(dir, "unscored.tsv")
+	if err := WriteTSV(unscored, run, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, scores, err = LoadRun(unscored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(docs["q"], run["q"]) || scores != nil {
+		t.Errorf("got %v with scores %v", docs, scores)
+	}
+
+	// Only the query without scores loses them
+	mixed := filepath.Join(dir, "mixed.tsv")
+	if err := os.WriteFile(mixed, []byte("q\tb\t1\t0.5\nq\ta\t2\t0.25\nq2\tc\t1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	docs, scores, err = LoadRun(mixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(docs["q2"], run["q2"]) || !slices.Equal(scores["q"], []float64{0.5, 0.25}) || scores["q2"] != nil {
+		t.Errorf("got %v with scores %v", docs, scores)
+	}
+}
@@ -0,0 +1,253 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Significance tests between runs. Every test is paired over queries: both runs are scored on the same queries and
+// the tests look at the per-query differences.
+
+const (
+	SignifTrials = 10000 // permutations/resamples for the randomisation test and the bootstrap
+	SignifAlpha  = 0.05  // the bootstrap gives a 1-SignifAlpha confidence interval
+)
+
+// Vectors lines up the per-query values of metric in every report over the union of their evaluated queries. A query
+// one of the runs has no answer for counts as 0 for that run.
+func Vectors(reports []Report, metric string) [][]float64 {
+	union := make(map[string]struct{})
+	for _, r := range reports {
+		for qid := range r.PerQuery {
+			union[qid] = struct{}{}
+		}
+	}
+	qids := make([]string, 0, len(union))
+	for qid := range union {
+		qids = append(qids, qid)
+	}
+	sort.Strings(qids)
+
+	vectors := make([][]float64, len(reports))
+	for i, r := range reports {
+		vectors[i] = make([]float64, len(qids))
+		for j, qid := range qids {
+			vectors[i][j] = r.PerQuery[qid][metric] // 0 if the query is missing
+		}
+	}
+	return vectors
+}
+
+// PairedTTest is the two sided paired t-test of a against b. Returns the t statistic and the p-value.
+func PairedTTest(a, b []float64) (float64, float64) {
+	n := len(a)
+	if n < 2 {
+		return 0, 1
+	}
+
+	diffs := differences(a, b)
+	mean := meanOf(diffs)
+	var ss float64
+	for _, d := range diffs {
+		ss += (d - mean) * (d - mean)
+	}
+	sd := math.Sqrt(ss / float64(n-1))
+	if sd == 0 {
+		if mean == 0 {
+			return 0, 1
+		}
+		return math.Inf(int(math.Copysign(1, mean))), 0
+	}
+
+	t := mean / (sd / math.Sqrt(float64(n)))
+	df := float64(n - 1)
+	return t, regIncBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// RandomisationTest is the two sided paired randomisation (sign flip) test of a against b: the fraction of random
+// relabellings whose mean difference is at least as extreme as the observed one.
+func RandomisationTest(a, b []float64, trials int, rng *rand.Rand) float64 {
+	diffs := differences(a, b)
+	if len(diffs) == 0 {
+		return 1
+	}
+	observed := math.Abs(meanOf(diffs))
+
+	extreme := 0
+	for range trials {
+		var sum float64
+		for _, d := range diffs {
+			if rng.Intn(2) == 0 {
+				d = -d
+			}
+			sum += d
+		}
+		if math.Abs(sum/float64(len(diffs))) >= observed-1e-12 {
+			extreme++
+		}
+	}
+	// +1 so the p-value is never 0 with a finite number of trials
+	return float64(extreme+1) / float64(trials+1)
+}
+
+// BootstrapCI is the percentile bootstrap confidence interval (1-alpha) of the mean of a-b over resampled queries.
+func BootstrapCI(a, b []float64, trials int, alpha float64, rng *rand.Rand) (float64, float64) {
+	diffs := differences(a, b)
+	if len(diffs) == 0 {
+		return 0, 0
+	}
+
+	means := make([]float64, trials)
+	for i := range means {
+		var sum float64
+		for range diffs {
+			sum += diffs[rng.Intn(len(diffs))]
+		}
+		means[i] = sum / float64(len(diffs))
+	}
+	sort.Float64s(means)
+
+	lo := int(math.Floor(alpha / 2 * float64(trials)))
+	hi := int(math.Ceil((1-alpha/2)*float64(trials))) - 1
+	return means[max(lo, 0)], means[min(hi, trials-1)]
+}
+
+// Comparison is one run against the baseline on one metric.
+type Comparison struct {
+	Run, Metric    string
+	Mean, Baseline float64
+	T, TTestP      float64
+	RandP          float64
+	CILow, CIHigh  float64 // bootstrap CI of Mean-Baseline
+	Queries        int
+}
+
+// Compare tests every report against reports[0] (the baseline) on every metric.
+func Compare(names []string, reports []Report, metrics []string, rng *rand.Rand) []Comparison {
+	var out []Comparison
+	for _, metric := range metrics {
+		vectors := Vectors(reports, metric)
+		base := vectors[0]
+		for i := 1; i < len(reports); i++ {
+			c := Comparison{
+				Run:      names[i],
+				Metric:   metric,
+				Mean:     meanOf(vectors[i]),
+				Baseline: meanOf(base),
+				Queries:  len(base),
+			}
+			c.T, c.TTestP = PairedTTest(vectors[i], base)
+			c.RandP = RandomisationTest(vectors[i], base, SignifTrials, rng)
+			c.CILow, c.CIHigh = BootstrapCI(vectors[i], base, SignifTrials, SignifAlpha, rng)
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// ComparisonTable lays the comparisons out as a plain text table, with a * on the runs that differ from the baseline
+// at SignifAlpha under both tests.
+func ComparisonTable(baseline string, comparisons []Comparison) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Baseline: %s\n", baseline)
+	fmt.Fprintf(&sb, "%-12s %-30s %8s %8s %8s %8s %8s %20s\n", "metric", "run", "base", "run", "diff", "t-test p",
+		"rand p", fmt.Sprintf("%.0f%% CI", 100*(1-SignifAlpha)))
+	for _, c := range comparisons {
+		mark := ""
+		if c.TTestP < SignifAlpha && c.RandP < SignifAlpha {
+			mark = " *"
+		}
+		fmt.Fprintf(&sb, "%-12s %-30s %8.4f %8.4f %+8.4f %8.4f %8.4f [%+8.4f, %+8.4f]%s\n", c.Metric, c.Run, c.Baseline,
+			c.Mean, c.Mean-c.Baseline, c.TTestP, c.RandP, c.CILow, c.CIHigh, mark)
+	}
+	return sb.String()
+}
+
+func differences(a, b []float64) []float64 {
+	diffs := make([]float64, len(a))
+	for i := range a {
+		diffs[i] = a[i] - b[i]
+	}
+	return diffs
+}
+
+func meanOf(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// regIncBeta is the regularised incomplete beta function I_x(a, b), by the continued fraction in Numerical Recipes.
+func regIncBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+
+	// The continued fraction converges quickly only on this side
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaCF(b, a, 1-x)/b
+	}
+	return front * betaCF(a, b, x) / a
+}
+
+func betaCF(a, b, x float64) float64 {
+	const (
+		maxIter = 300
+		eps     = 1e-14
+		tiny    = 1e-300
+	)
+
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIter; m++ {
+		fm := float64(m)
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return h
+}
@@ -0,0 +1,78 @@
+package eval
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPairedTTest(t *testing.T) {
+	// The t distribution has a closed form CDF for 1 and 2 degrees of freedom
+	tests := []struct {
+		a, b  []float64
+		wantT float64
+		wantP float64
+	}{
+		{[]float64{1, 3}, []float64{0, 0}, 2, 1 - 2/math.Pi*math.Atan(2)},
+		{[]float64{2, 3, 4}, []float64{1, 1, 1}, 2 * math.Sqrt(3), 1 - 2*math.Sqrt(3)/math.Sqrt(14)},
+	}
+	for _, tt := range tests {
+		gotT, gotP := PairedTTest(tt.a, tt.b)
+		if !near(gotT, tt.wantT) || !near(gotP, tt.wantP) {
+			t.Errorf("PairedTTest(%v, %v) = %f, %f, want %f, %f", tt.a, tt.b, gotT, gotP, tt.wantT, tt.wantP)
+		}
+	}
+
+	if _, p := PairedTTest([]float64{1, 2, 3}, []float64{1, 2, 3}); p != 1 {
+		t.Errorf("identical runs got p %f, want 1", p)
+	}
+}
+
+func TestRandomisationTest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	a := make([]float64, 20)
+	b := make([]float64, 20)
+	for i := range a {
+		a[i] = 1
+	}
+
+	if p := RandomisationTest(a, a, 1000, rng); p != 1 {
+		t.Errorf("identical runs got p %f, want 1", p)
+	}
+	// Only 2 of the 2^20 sign flips are as extreme
+	if p := RandomisationTest(a, b, 1000, rng); p > 0.01 {
+		t.Errorf("a always beats b but p is %f", p)
+	}
+}
+
+func TestBootstrapCI(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	lo, hi := BootstrapCI([]float64{3, 3, 3}, []float64{1, 1, 1}, 1000, 0.05, rng)
+	if lo != 2 || hi != 2 {
+		t.Errorf("constant difference got CI [%f, %f], want [2, 2]", lo, hi)
+	}
+
+	a := []float64{0.5, 0.2, 0.9, 0.4, 0.7, 0.1, 0.3}
+	b := []float64{0.4, 0.1, 0.6, 0.5, 0.3, 0.1, 0.2}
+	lo, hi = BootstrapCI(a, b, 1000, 0.05, rng)
+	mean := meanOf(differences(a, b))
+	if lo > mean || hi < mean || lo < -0.1 || hi > 0.4 {
+		t.Errorf("CI [%f, %f] doesn't fit the mean difference %f", lo, hi, mean)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	a := Report{PerQuery: map[string]map[string]float64{"q1": {"m": 1}, "q2": {"m": 0.5}}}
+	b := Report{PerQuery: map[string]map[string]float64{"q2": {"m": 0.25}, "q3": {"m": 1}}}
+
+	vectors := Vectors([]Report{a, b}, "m")
+	want := [][]float64{{1, 0.5, 0}, {0, 0.25, 1}}
+	for i := range want {
+		for j := range want[i] {
+			if vectors[i][j] != want[i][j] {
+				t.Fatalf("got %v, want %v", vectors, want)
+			}
+		}
+	}
+}
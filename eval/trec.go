@@ -0,0 +1,192 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteRun writes run as a TREC run file: "qid Q0 docid rank score tag", QIDs sorted. scores (same shape as run) can be
+// nil, the docs then get descending scores from their rank so trec_eval keeps the order.
+func WriteRun(path string, run map[string][]string, scores map[string][]float64, tag string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	qids := make([]string, 0, len(run))
+	for qid := range run {
+		qids = append(qids, qid)
+	}
+	sort.Strings(qids)
+
+	for _, qid := range qids {
+		docs := run[qid]
+		for i, docID := range docs {
+			score := float64(len(docs) - i)
+			if s := scores[qid]; len(s) == len(docs) {
+				score = s[i]
+			}
+			fmt.Fprintf(w, "%s Q0 %s %d %g %s\n", qid, docID, i+1, score, tag)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadRun reads a TREC run file, or a TSV written by WriteTSV, back into docs and scores, each query ordered by rank.
+// A query with a TSV line without a score has no scores, and scores is nil if no query has any.
+func LoadRun(path string) (map[string][]string, map[string][]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	type line struct {
+		docID string
+		rank  int
+		score float64
+	}
+	lines := make(map[string][]line)
+	unscored := make(map[string]bool)
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// TREC is "qid Q0 docid rank score tag", the TSV "qid docid rank [score]"
+		var docID, rankField, scoreField string
+		switch len(fields) {
+		case 6:
+			docID, rankField, scoreField = fields[2], fields[3], fields[4]
+		case 4:
+			docID, rankField, scoreField = fields[1], fields[2], fields[3]
+		case 3:
+			docID, rankField = fields[1], fields[2]
+			unscored[fields[0]] = true
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: %d fields, want 6 (TREC) or 3-4 (TSV)", path, n, len(fields))
+		}
+		rank, err := strconv.Atoi(rankField)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		var score float64
+		if scoreField != "" {
+			if score, err = strconv.ParseFloat(scoreField, 64); err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		}
+		lines[fields[0]] = append(lines[fields[0]], line{docID, rank, score})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	docs := make(map[string][]string, len(lines))
+	scores := make(map[string][]float64, len(lines))
+	for qid, ls := range lines {
+		sort.SliceStable(ls, func(i, j int) bool { return ls[i].rank < ls[j].rank })
+		for _, l := range ls {
+			docs[qid] = append(docs[qid], l.docID)
+			if !unscored[qid] {
+				scores[qid] = append(scores[qid], l.score)
+			}
+		}
+	}
+	if len(scores) == 0 {
+		scores = nil
+	}
+	return docs, scores, nil
+}
+
+// WriteEval writes the report in trec_eval's "metric qid value" layout, under trec_eval's names (see trecName): every
+// query, then the means under "all".
+func WriteEval(path string, report Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	for _, qid := range report.QIDs() {
+		for _, name := range report.Metrics {
+			if trec := trecName(name); trec != "" {
+				fmt.Fprintf(w, "%s\t%s\t%.4f\n", trec, qid, report.PerQuery[qid][name])
+			}
+		}
+	}
+	fmt.Fprintf(w, "num_q\tall\t%d\n", len(report.PerQuery))
+	for _, name := range report.Metrics {
+		if trec := trecName(name); trec != "" {
+			fmt.Fprintf(w, "%s\tall\t%.4f\n", trec, report.Mean[name])
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// trecName is what trec_eval calls metric (ndcg@10 is ndcg_cut_10, P@10 is P_10...), or "" for mrr@k, which it has no
+// cut off version of. It has recip_rank over the whole ranking instead, which Evaluate computes too.
+func trecName(metric string) string {
+	name, k, cut := strings.Cut(metric, "@")
+	switch {
+	case !cut:
+		return metric // map, recip_rank
+	case name == "ndcg":
+		return "ndcg_cut_" + k
+	case name == "mrr":
+		return ""
+	default:
+		return name + "_" + k // P, recall, success
+	}
+}
+
+// WriteTSV writes run as "qid<TAB>docid<TAB>rank" lines (what the Python re-rankers read), with a fourth score column
+// for the queries scores has scores for. scores can be nil.
+func WriteTSV(path string, run map[string][]string, scores map[string][]float64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	qids := make([]string, 0, len(run))
+	for qid := range run {
+		qids = append(qids, qid)
+	}
+	sort.Strings(qids)
+
+	for _, qid := range qids {
+		docs := run[qid]
+		s := scores[qid]
+		for i, docID := range docs {
+			if len(s) == len(docs) {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%g\n", qid, docID, i+1, s[i])
+			} else {
+				fmt.Fprintf(w, "%s\t%s\t%d\n", qid, docID, i+1)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,251 @@
+// Package fusion combines the answers of several searches (bins, Pacmann, BM25 re-ranks...) into one ranking.
+//
+// Rank based: RRF. Score based: CombSUM, CombMNZ and weighted linear fusion. The score based methods min-max normalise
+// the scores of every run per query first, so runs with different score ranges mix. Runs without scores get one from
+// their ranks instead: 1 for the first doc down to 1/n for the last.
+package fusion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dkblackley/bins-go/eval"
+)
+
+const (
+	MethodRRF     = "rrf"
+	MethodCombSUM = "combsum"
+	MethodCombMNZ = "combmnz"
+	MethodLinear  = "linear"
+
+	RRFK = 60 // the usual constant from the RRF paper
+)
+
+// Run is the answers of one search, the QID -> doc IDs (best first) map that writeAnswers writes out.
+type Run struct {
+	Name   string
+	Docs   map[string][]string
+	Scores map[string][]float64 // Scores[qid][i] is the score of Docs[qid][i], nil if the search has none
+	Weight float64              // only used by linear fusion
+}
+
+// LoadRun reads answers written by writeAnswers: the JSON map, or a TREC run file or TSV (which keep the scores).
+func LoadRun(path string) (Run, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Run{}, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		docs, scores, err := eval.LoadRun(path)
+		if err != nil {
+			return Run{}, err
+		}
+		return Run{Name: path, Docs: docs, Scores: scores, Weight: 1}, nil
+	}
+
+	docs := make(map[string][]string)
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return Run{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return Run{Name: path, Docs: docs, Weight: 1}, nil
+}
+
+// Fuse combines runs with method. The fused run has a score for every doc.
+func Fuse(method string, runs []Run) (Run, error) {
+	var fuse func(lists []ranked) map[string]float64
+	switch method {
+	case MethodRRF:
+		fuse = rrf
+	case MethodCombSUM:
+		fuse = combSUM
+	case MethodCombMNZ:
+		fuse = combMNZ
+	case MethodLinear:
+		fuse = linear
+	default:
+		return Run{}, fmt.Errorf("unknown fusion method %q, options are %s|%s|%s|%s", method, MethodRRF,
+			MethodCombSUM, MethodCombMNZ, MethodLinear)
+	}
+
+	qids := make(map[string]struct{})
+	for _, run := range runs {
+		for qid := range run.Docs {
+			qids[qid] = struct{}{}
+		}
+	}
+
+	fused := Run{
+		Name:   method,
+		Docs:   make(map[string][]string, len(qids)),
+		Scores: make(map[string][]float64, len(qids)),
+		Weight: 1,
+	}
+	for qid := range qids {
+		lists := make([]ranked, len(runs))
+		for i, run := range runs {
+			lists[i] = run.query(qid)
+		}
+		fused.Docs[qid], fused.Scores[qid] = sortScores(fuse(lists))
+	}
+	return fused, nil
+}
+
+// RRF fuses the runs by the reciprocal of the rank of each doc (plus RRFK), summed over the runs.
+func RRF(runs []Run) (Run, error) {
+	return Fuse(MethodRRF, runs)
+}
+
+// CombSUM sums the normalised scores of the runs.
+func CombSUM(runs []Run) (Run, error) {
+	return Fuse(MethodCombSUM, runs)
+}
+
+// CombMNZ is CombSUM multiplied by the number of runs a doc is in.
+func CombMNZ(runs []Run) (Run, error) {
+	return Fuse(MethodCombMNZ, runs)
+}
+
+// Linear sums the normalised scores of the runs, each multiplied by the run's Weight.
+func Linear(runs []Run) (Run, error) {
+	return Fuse(MethodLinear, runs)
+}
+
+// RRFRankings is RRF over the rankings of a single query, best first, with the fused scores.
+func RRFRankings(rankings [][]string) ([]string, []float64) {
+	lists := make([]ranked, len(rankings))
+	for i, docs := range rankings {
+		lists[i] = ranked{docs: docs, weight: 1}.dedupe()
+	}
+	return sortScores(rrf(lists))
+}
+
+// ranked is the answer of one run to one query.
+type ranked struct {
+	docs   []string
+	scores []float64 // nil if the run has no scores
+	weight float64
+}
+
+func (r Run) query(qid string) ranked {
+	var scores []float64
+	if r.Scores != nil {
+		scores = r.Scores[qid]
+	}
+	return ranked{docs: r.Docs[qid], scores: scores, weight: r.Weight}.dedupe()
+}
+
+// dedupe keeps only the first (best) time every doc is in the list, like eval does, so no run counts a doc twice.
+func (r ranked) dedupe() ranked {
+	out := ranked{docs: make([]string, 0, len(r.docs)), weight: r.weight}
+	hasScores := len(r.scores) == len(r.docs)
+	if hasScores {
+		out.scores = make([]float64, 0, len(r.docs))
+	}
+	seen := make(map[string]struct{}, len(r.docs))
+	for i, docID := range r.docs {
+		if _, ok := seen[docID]; ok {
+			continue
+		}
+		seen[docID] = struct{}{}
+		out.docs = append(out.docs, docID)
+		if hasScores {
+			out.scores = append(out.scores, r.scores[i])
+		}
+	}
+	return out
+}
+
+// normalised min-max normalises the scores of the list into [0, 1], or scores it by rank if it has no scores.
+func (r ranked) normalised() []float64 {
+	out := make([]float64, len(r.docs))
+	if len(r.docs) == 0 {
+		return out
+	}
+	if len(r.scores) != len(r.docs) {
+		for i := range out {
+			out[i] = 1 - float64(i)/float64(len(r.docs))
+		}
+		return out
+	}
+
+	lo, hi := r.scores[0], r.scores[0]
+	for _, s := range r.scores {
+		lo, hi = min(lo, s), max(hi, s)
+	}
+	for i, s := range r.scores {
+		out[i] = 1
+		if hi > lo {
+			out[i] = (s - lo) / (hi - lo)
+		}
+	}
+	return out
+}
+
+func rrf(lists []ranked) map[string]float64 {
+	fused := make(map[string]float64)
+	for _, list := range lists {
+		for rank, docID := range list.docs {
+			fused[docID] += 1 / float64(RRFK+rank+1)
+		}
+	}
+	return fused
+}
+
+func combSUM(lists []ranked) map[string]float64 {
+	fused := make(map[string]float64)
+	for _, list := range lists {
+		for i, score := range list.normalised() {
+			fused[list.docs[i]] += score
+		}
+	}
+	return fused
+}
+
+// combMNZ is CombSUM multiplied by the number of runs the doc is in.
+func combMNZ(lists []ranked) map[string]float64 {
+	fused := combSUM(lists)
+	hits := make(map[string]int, len(fused))
+	for _, list := range lists {
+		for _, docID := range list.docs {
+			hits[docID]++
+		}
+	}
+	for docID := range fused {
+		fused[docID] *= float64(hits[docID])
+	}
+	return fused
+}
+
+func linear(lists []ranked) map[string]float64 {
+	fused := make(map[string]float64)
+	for _, list := range lists {
+		for i, score := range list.normalised() {
+			fused[list.docs[i]] += list.weight * score
+		}
+	}
+	return fused
+}
+
+// sortScores orders the docs best score first (ties by doc ID).
+func sortScores(fused map[string]float64) ([]string, []float64) {
+	docs := make([]string, 0, len(fused))
+	for docID := range fused {
+		docs = append(docs, docID)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if fused[docs[i]] != fused[docs[j]] {
+			return fused[docs[i]] > fused[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+
+	scores := make([]float64, len(docs))
+	for i, docID := range docs {
+		scores[i] = fused[docID]
+	}
+	return docs, scores
+}
@@ -0,0 +1,135 @@
+package fusion
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func testRuns() []Run {
+	return []Run{
+		{Name: "a", Docs: map[string][]string{"q": {"1", "2", "3"}}, Weight: 1},
+		{Name: "b", Docs: map[string][]string{"q": {"3", "1", "4"}, "q2": {"5"}}, Weight: 1},
+	}
+}
+
+func TestFuse(t *testing.T) {
+	tests := []struct {
+		method string
+		want   []string
+	}{
+		// 1 is 1st and 2nd, 3 is 3rd and 1st
+		{MethodRRF, []string{"1", "3", "2", "4"}},
+		// Rank scores: 1 gets 1+2/3, 3 gets 1/3+1, 2 gets 2/3, 4 gets 1/3
+		{MethodCombSUM, []string{"1", "3", "2", "4"}},
+		{MethodCombMNZ, []string{"1", "3", "2", "4"}},
+		{MethodLinear, []string{"1", "3", "2", "4"}},
+	}
+	for _, tt := range tests {
+		fused, err := Fuse(tt.method, testRuns())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(fused.Docs["q"], tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.method, fused.Docs["q"], tt.want)
+		}
+		if !slices.Equal(fused.Docs["q2"], []string{"5"}) {
+			t.Errorf("%s: got %v for q2, want [5]", tt.method, fused.Docs["q2"])
+		}
+		if len(fused.Scores["q"]) != len(fused.Docs["q"]) {
+			t.Errorf("%s: %d scores for %d docs", tt.method, len(fused.Scores["q"]), len(fused.Docs["q"]))
+		}
+	}
+
+	if _, err := Fuse("nope", testRuns()); err == nil {
+		t.Error("unknown method should fail")
+	}
+}
+
+func TestFuseDuplicates(t *testing.T) {
+	// Run a lists 2 three times, which mustn't get it past 1
+	runs := []Run{
+		{Docs: map[string][]string{"q": {"1", "2", "2", "2"}}, Scores: map[string][]float64{"q": {4, 3, 2, 1}}, Weight: 1},
+		{Docs: map[string][]string{"q": {"1", "2"}}, Weight: 1},
+	}
+	for _, method := range []string{MethodRRF, MethodCombSUM, MethodCombMNZ, MethodLinear} {
+		fused, err := Fuse(method, runs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(fused.Docs["q"], []string{"1", "2"}) {
+			t.Errorf("%s: got %v %v, want [1 2]", method, fused.Docs["q"], fused.Scores["q"])
+		}
+	}
+}
+
+func TestLinearWeights(t *testing.T) {
+	runs := testRuns()
+	runs[1].Weight = 10
+
+	fused, err := Linear(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fused.Docs["q"], []string{"3", "1", "4", "2"}) {
+		t.Errorf("got %v, run b should dominate", fused.Docs["q"])
+	}
+}
+
+func TestScoresNormalised(t *testing.T) {
+	// Both runs are min-max normalised into [0, 1] before they are summed, whatever their scale
+	runs := []Run{
+		{Docs: map[string][]string{"q": {"1", "2", "3"}}, Scores: map[string][]float64{"q": {1, 0.9, 0}}, Weight: 1},
+		{Docs: map[string][]string{"q": {"2", "1"}}, Scores: map[string][]float64{"q": {1000, 0}}, Weight: 1},
+	}
+
+	fused, err := CombSUM(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fused.Docs["q"], []string{"2", "1", "3"}) {
+		t.Fatalf("got %v, want [2 1 3]", fused.Docs["q"])
+	}
+	for i, want := range []float64{1.9, 1, 0} {
+		if math.Abs(fused.Scores["q"][i]-want) > 1e-9 {
+			t.Errorf("doc %s scored %f, want %f", fused.Docs["q"][i], fused.Scores["q"][i], want)
+		}
+	}
+}
+
+func TestLoadRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	data, err := json.Marshal(map[string][]string{"q": {"1", "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run, err := LoadRun(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(run.Docs["q"], []string{"1", "2"}) || run.Weight != 1 || run.Scores != nil {
+		t.Errorf("got %+v", run)
+	}
+}
+
+func TestLoadTRECRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.trec")
+	if err := os.WriteFile(path, []byte("q Q0 2 1 9.5 bins\nq Q0 1 2 3 bins\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run, err := LoadRun(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(run.Docs["q"], []string{"2", "1"}) || !slices.Equal(run.Scores["q"], []float64{9.5, 3}) {
+		t.Errorf("got %+v", run)
+	}
+}
@@ -0,0 +1,83 @@
+package globals
+
+import (
+	"encoding/gob"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// EncodedAnswers are the answers of the search stage, before they are decoded into doc IDs. They keep what decoding
+// them needs, so the decode stage doesn't have to be given the same flags again.
+type EncodedAnswers struct {
+	Dataset    string
+	SearchType string
+	K          uint
+	Dimensions uint
+	Answers    map[string]Decodable
+}
+
+// savedAnswers is how EncodedAnswers are gobbed. gob writes a map in iteration order, so the answers are stored sorted
+// by QID instead, which keeps the file the same for the same answers.
+type savedAnswers struct {
+	Dataset    string
+	SearchType string
+	K          uint
+	Dimensions uint
+	QIDs       []string
+	Answers    []Decodable
+}
+
+// SaveEncodedAnswers gobs answers to path. Every Decodable type in there has to be gob.Register'ed by its package.
+func SaveEncodedAnswers(path string, answers EncodedAnswers) error {
+	saved := savedAnswers{
+		Dataset:    answers.Dataset,
+		SearchType: answers.SearchType,
+		K:          answers.K,
+		Dimensions: answers.Dimensions,
+		QIDs:       slices.Sorted(maps.Keys(answers.Answers)),
+	}
+	for _, qid := range saved.QIDs {
+		saved.Answers = append(saved.Answers, answers.Answers[qid])
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(saved); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// LoadEncodedAnswers reads answers written by SaveEncodedAnswers.
+func LoadEncodedAnswers(path string) (EncodedAnswers, error) {
+	var answers EncodedAnswers
+	f, err := os.Open(path)
+	if err != nil {
+		return answers, err
+	}
+	defer f.Close()
+	var saved savedAnswers
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return answers, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(saved.QIDs) != len(saved.Answers) {
+		return answers, fmt.Errorf("%s: %d QIDs but %d answers", path, len(saved.QIDs), len(saved.Answers))
+	}
+
+	answers = EncodedAnswers{
+		Dataset:    saved.Dataset,
+		SearchType: saved.SearchType,
+		K:          saved.K,
+		Dimensions: saved.Dimensions,
+		Answers:    make(map[string]Decodable, len(saved.QIDs)),
+	}
+	for i, qid := range saved.QIDs {
+		answers.Answers[qid] = saved.Answers[i]
+	}
+	return answers, nil
+}
@@ -0,0 +1,68 @@
+package globals
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Checkpoint is how far the search stage got: the answers so far and the state of the PIR client that answered them.
+// A search run with -load carries on after Next instead of starting over. The random sources outside the PIR (the
+// padding of the bins, the random vertices of the graph) are reseeded from Rand when it is saved, so a resumed run of
+// the same -seed draws the same numbers as a run that wasn't cut off. PIR holds the secret keys of the client, so a
+// checkpoint tells whoever reads it what was queried: SaveCheckpoint writes it readable by its owner only.
+type Checkpoint struct {
+	Dataset    string
+	SearchType string
+	K          uint
+	Seed       int64
+	QIDs       []string // all the queries of the run in the order they are answered
+	Next       int      // index into QIDs of the first query that isn't done
+
+	Answers     map[string]Decodable
+	Mismatches  int           // -diffPrivate answers that differed so far
+	Maintenance time.Duration // offline phases rerun so far
+	PIR         []byte        // SimpleBatchPianoPIR.SaveState (with the keys), nil without PIR
+	Rand        int64         // seed the random sources outside the PIR carry on from
+}
+
+// SaveCheckpoint gobs c to path. It is written next to path first and then moved over it, so a run that is killed
+// while saving leaves the last checkpoint as it was. The file is created 0600 (os.CreateTemp), as it holds the keys.
+func SaveCheckpoint(path string, c Checkpoint) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCheckpoint reads a checkpoint written by SaveCheckpoint.
+func LoadCheckpoint(path string) (Checkpoint, error) {
+	var c Checkpoint
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Answers == nil { // gob leaves out empty maps
+		c.Answers = make(map[string]Decodable)
+	}
+	return c, nil
+}
@@ -0,0 +1,193 @@
+package globals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dataset registry. Every dataset names its files relative to the -dataset root (absolute paths are kept as they
+// are), so new BEIR datasets are a JSON entry away:
+//
+//	{
+//	  "scifact": {
+//	    "name": "SciFact",
+//	    "index": "index_scifact",
+//	    "corpus": "scifact/corpus.jsonl",
+//	    "queries": "scifact/queries.jsonl",
+//	    "qrels": "scifact/qrels/test.tsv",
+//	    "corpusVec": "scifact/corpus_192.npy",
+//	    "queryVec": "scifact/queries_192.npy",
+//	    "graph": "scifact/corpus_192_graph.npy",
+//	    "dim": 192,
+//	    "fields": {"title": ["title"], "text": ["text", "abstract"]},
+//	    "analyzer": "strict-english"
+//	  }
+//	}
+
+// DatasetEntry is one dataset of the registry, as it is written in the JSON.
+type DatasetEntry struct {
+	Name       string `json:"name"`
+	IndexDir   string `json:"index"`
+	Corpus     string `json:"corpus"`
+	Queries    string `json:"queries"`
+	Qrels      string `json:"qrels"`
+	CorpusVec  string `json:"corpusVec"`
+	QueryVec   string `json:"queryVec"`
+	Graph      string `json:"graph"`
+	Dimensions uint   `json:"dim"` // 0 leaves it to -dim
+	// Which fields of the corpus lines hold the title and the text, for corpora that don't use the BEIR ones
+	Fields CorpusFields `json:"fields"`
+	// Analyzer for the index, the bins and the queries, see bins/analyzers.go ("" for strict-english)
+	Analyzer string `json:"analyzer"`
+}
+
+type DatasetRegistry map[string]DatasetEntry
+
+// DefaultDatasets is the registry used without -datasetConfig. They all share the MS MARCO vectors.
+func DefaultDatasets() DatasetRegistry {
+	shared := DatasetEntry{
+		CorpusVec:  "Son/my_vectors_192.npy",
+		QueryVec:   "Son/query_192_float32.npy",
+		Graph:      "Son/my_vectors_192_8841823_192_32_graph.npy",
+		Dimensions: 192,
+	}
+
+	marco := shared
+	marco.Name, marco.IndexDir = "Marco", "index_marco"
+	marco.Corpus, marco.Queries = "msmarco/corpus.jsonl", "msmarco/queries.dev.small.jsonl"
+	marco.Qrels = "msmarco/qrels/qrels.dev.tsv"
+
+	scifact := shared
+	scifact.Name, scifact.IndexDir = "SciFact", "index_scifact"
+	scifact.Corpus, scifact.Queries = "scifact/corpus.jsonl", "scifact/queries.jsonl"
+	scifact.Qrels = "scifact/qrels/test.tsv"
+
+	debug := marco
+	debug.Corpus, debug.Queries = "msmarco/corpus_debug.jsonl", "msmarco/queries.dev.small_debug.jsonl"
+	debug.CorpusVec, debug.Graph = "Son/my_vectors_192_debug.npy", "Son/debug_graph.npy"
+
+	covid := shared
+	covid.Name, covid.IndexDir = "TREC-COVID", "index_trec_covid"
+	covid.Corpus, covid.Queries = "trec-covid/corpus.jsonl", "trec-covid/queries.jsonl"
+	covid.Qrels = "trec-covid/qrels/test.tsv"
+
+	return DatasetRegistry{
+		"msmarco":    marco,
+		"scifact":    scifact,
+		"debug":      debug,
+		"trec-covid": covid,
+	}
+}
+
+// LoadDatasetRegistry reads a registry JSON, see the top of this file. Unknown fields are an error, so typos don't
+// silently leave a path empty.
+func LoadDatasetRegistry(path string) (DatasetRegistry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var registry DatasetRegistry
+	if err := dec.Decode(&registry); err != nil {
+		return nil, fmt.Errorf("dataset config %s: %w", path, err)
+	}
+	return registry, nil
+}
+
+// Resolve looks name up and puts its paths under root.
+func (r DatasetRegistry) Resolve(root, name string) (DatasetMetadata, error) {
+	entry, ok := r[name]
+	if !ok {
+		names := make([]string, 0, len(r))
+		for n := range r {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return DatasetMetadata{}, fmt.Errorf("unknown dataset %q, options are %s", name, strings.Join(names, "|"))
+	}
+
+	under := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(root, path)
+	}
+
+	displayName := entry.Name
+	if displayName == "" {
+		displayName = name
+	}
+	return DatasetMetadata{
+		Name:        displayName,
+		IndexDir:    under(entry.IndexDir),
+		OriginalDir: under(entry.Corpus),
+		Queries:     under(entry.Queries),
+		Qrels:       under(entry.Qrels),
+		Vectors: Vectors{
+			CorpusVec: under(entry.CorpusVec),
+			QueryVec:  under(entry.QueryVec),
+			Graph:     under(entry.Graph),
+		},
+		Dimensions: entry.Dimensions,
+		Fields:     entry.Fields,
+		Analyzer:   entry.Analyzer,
+	}, nil
+}
+
+// Dataset files, as named in the registry JSON.
+const (
+	FileIndex     = "index"
+	FileCorpus    = "corpus"
+	FileQueries   = "queries"
+	FileQrels     = "qrels"
+	FileCorpusVec = "corpusVec"
+	FileQueryVec  = "queryVec"
+	FileGraph     = "graph"
+)
+
+// Path is where file of the dataset is, "" if the registry doesn't say.
+func (m DatasetMetadata) Path(file string) string {
+	switch file {
+	case FileIndex:
+		return m.IndexDir
+	case FileCorpus:
+		return m.OriginalDir
+	case FileQueries:
+		return m.Queries
+	case FileQrels:
+		return m.Qrels
+	case FileCorpusVec:
+		return m.Vectors.CorpusVec
+	case FileQueryVec:
+		return m.Vectors.QueryVec
+	case FileGraph:
+		return m.Vectors.Graph
+	}
+	return ""
+}
+
+// Validate checks that every one of files is set and exists, and names all the ones that don't in the error.
+func (m DatasetMetadata) Validate(files ...string) error {
+	var problems []string
+	for _, file := range files {
+		path := m.Path(file)
+		if path == "" {
+			problems = append(problems, fmt.Sprintf("%s is not set", file))
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v", file, path, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("dataset %s is missing files:\n  %s", m.Name, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
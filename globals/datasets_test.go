@@ -0,0 +1,60 @@
+package globals
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDatasetRegistry(t *testing.T) {
+	root := t.TempDir()
+	config := filepath.Join(root, "datasets.json")
+	registryJSON := `{"nfcorpus": {"corpus": "nfcorpus/corpus.jsonl", "qrels": "/abs/qrels.tsv", "dim": 384,
+		"analyzer": "multilingual"}}`
+	if err := os.WriteFile(config, []byte(registryJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := LoadDatasetRegistry(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := registry.Resolve(root, "nfcorpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "nfcorpus" || meta.Dimensions != 384 || meta.Qrels != "/abs/qrels.tsv" || meta.Analyzer != "multilingual" ||
+		meta.OriginalDir != filepath.Join(root, "nfcorpus/corpus.jsonl") {
+		t.Errorf("got %+v", meta)
+	}
+
+	if _, err := registry.Resolve(root, "fiqa"); err == nil || !strings.Contains(err.Error(), "nfcorpus") {
+		t.Errorf("unknown dataset should list the known ones, got %v", err)
+	}
+
+	// The corpus doesn't exist yet and the queries aren't set
+	err = meta.Validate(FileCorpus, FileQueries)
+	if err == nil || !strings.Contains(err.Error(), "corpus") || !strings.Contains(err.Error(), "queries is not set") {
+		t.Errorf("got %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "nfcorpus"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(meta.OriginalDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.Validate(FileCorpus); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDatasetRegistryUnknownField(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "datasets.json")
+	if err := os.WriteFile(config, []byte(`{"x": {"corpusVecs": "typo.npy"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDatasetRegistry(config); err == nil {
+		t.Error("a misspelt field should be an error")
+	}
+}
@@ -2,6 +2,7 @@ package globals
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/kshedden/gonpy"
 )
@@ -15,18 +16,47 @@ type Args struct {
 	Dimensions        uint
 	DBSize            uint
 	BinSize           uint
-	Threshold         uint
+	Threshold         uint   // Max docs per bin before the overflow policy kicks in (0 for no cap)
+	MinHits           uint   // Words with this many hits or fewer are left out of the bins
+	Overflow          string // What to do with bins bigger than Threshold: drop|spill|split
+	OverflowBins      uint   // Number of overflow bins for the spill policy (0 for BinSize/10)
 	DChoice           uint
+	Ngram             uint   // Longest n-gram to bin alongside the unigrams (1 for unigrams only)
+	NgramMinFreq      uint   // N-grams in fewer docs than this are not binned
+	BinBuilder        string // Where the hits of every word come from: postings|search|compare
+	BatchSize         uint   // PIR indices per query, every query is padded or cut to exactly this many (0: unpadded)
+	TokenPolicy       string // Which query terms to keep when they don't all fit in the batch: idf|stopword|first
+	KeywordPIR        bool
+	PlacementHint     bool
 	Save              bool
 	Load              bool
 	DebugLevel        int
-	CheckPointFolder  string
+	CheckPointFolder  string // Where search saves its checkpoints
+	CheckPointEvery   uint   // Queries between checkpoints (0 for none)
+	Resume            bool   // Carry on from the checkpoint in CheckPointFolder instead of the first query
 	RTT               uint
 	OutFile           string
+	OutFormat         string // How OutFile is written: json|trec|tsv
+	ReRank            string // Dense re-ranking of the bins results: none|ip|l2
+	Private           bool   // Fetch through PIR, false reads the DB in plaintext (the no-privacy baseline)
+	DiffPrivate       bool   // Also answer every query in plaintext and count the answers that differ
 	QueryNum          uint
+	Workers           uint  // Goroutines for the vocab scan, the term searches and filling the bins (0 for one per CPU)
+	Seed              int64 // Seeds every math/rand source of the run, the same seed gives the same outputs
 	DatasetMeta       DatasetMetadata
-	IDLookup          map[[32]byte]string
-	Metadata          map[string]string
+	RunDir            string    // Fresh directory of this run, for its manifest and the files only it writes
+	Manifest          *Manifest `json:"-"`
+	PIRState          []byte    `json:"-"` // SaveState of the PIR client to load instead of running its offline phase
+	DocIDs            []string  `json:"-"` // Doc ID of every row of the corpus vectors, see DocID
+}
+
+// DocID is the ID of the doc whose vector is row of the corpus vectors (the vertex of the graph, the doc of a bins
+// entry). Without DocIDs loaded, or for a row it has no doc for, it is the row itself.
+func (a Args) DocID(row int) string {
+	if row < len(a.DocIDs) && a.DocIDs[row] != "" {
+		return a.DocIDs[row]
+	}
+	return strconv.Itoa(row)
 }
 
 // strconv.Itoa(docID)
@@ -46,6 +76,16 @@ type DatasetMetadata struct {
 	Queries     string
 	Qrels       string
 	Vectors     Vectors
+	Dimensions  uint // of the vectors, 0 if the registry doesn't say
+	Fields      CorpusFields
+	Analyzer    string // name of the analyzer terms are made with, "" for the default
+}
+
+// CorpusFields are the JSON fields of a corpus line the doc title and text are read from. Empty means the BEIR
+// defaults: the title from "title" (falling back on "url"), the text from "text" and "abstract".
+type CorpusFields struct {
+	Title []string `json:"title,omitempty"`
+	Text  []string `json:"text,omitempty"`
 }
 
 // Hacky interface
@@ -53,6 +93,12 @@ type Decodable interface {
 	Decode(config Args) []string
 }
 
+// ScoredDecodable is a Decodable that also has a score for every doc it returns (higher is better).
+type ScoredDecodable interface {
+	Decodable
+	DecodeScored(config Args) ([]string, []float64)
+}
+
 // Taken from graphann package. I think dim should be 192 and n should be 8841823 (ms marco size)
 func LoadFloat32MatrixFromNpy(filename string, n int, dim int) ([][]float32, error) {
 	r, err := gonpy.NewFileReader(filename)
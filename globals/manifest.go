@@ -0,0 +1,189 @@
+package globals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/dkblackley/bins-go/pianopir"
+)
+
+// ManifestFile is the name of the manifest in its run directory.
+const ManifestFile = "manifest.json"
+
+// Manifest records one run of a stage: what it ran with, on which inputs, what it wrote and what it measured. Every
+// run gets its own directory (see NewRunDir), so runs that share a working directory don't overwrite each other.
+type Manifest struct {
+	Stage     string    `json:"stage"`
+	Command   []string  `json:"command"`
+	Host      string    `json:"host"`
+	GitCommit string    `json:"gitCommit"` // "unknown" if the binary wasn't built from a git checkout
+	GoVersion string    `json:"goVersion"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Config    Args      `json:"config"`
+
+	Inputs  []FileDigest `json:"inputs"`
+	Outputs []FileDigest `json:"outputs"`
+
+	PIR     *pianopir.Info `json:"pir,omitempty"` // nil for stages (and -private=false runs) without PIR
+	Timings Timings        `json:"timings"`
+	Comm    *CommStats     `json:"comm,omitempty"`
+
+	Queries           int                `json:"queries,omitempty"`
+	CandidateRecall   *float64           `json:"candidateRecall,omitempty"`
+	PrivateMismatches *int               `json:"privateMismatches,omitempty"` // only with -diffPrivate
+	Metrics           map[string]float64 `json:"metrics,omitempty"`           // mean over the evaluated queries
+	Notes             map[string]string  `json:"notes,omitempty"`             // anything else worth keeping
+}
+
+// FileDigest is a file a run read or wrote. Directories (the index) are described by the metadata file in them.
+type FileDigest struct {
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Timings are in seconds, zero for the phases a stage doesn't have.
+type Timings struct {
+	Total         float64 `json:"total"`
+	Preprocessing float64 `json:"preprocessing,omitempty"`
+	Answering     float64 `json:"answering,omitempty"`
+	Maintenance   float64 `json:"maintenance,omitempty"` // offline phases rerun once the hints ran out, part of Answering
+	Decoding      float64 `json:"decoding,omitempty"`
+	Building      float64 `json:"building,omitempty"`      // the index, bins or graph
+	Checkpointing float64 `json:"checkpointing,omitempty"` // saving checkpoints, part of Answering
+}
+
+// CommStats is what the PIR queries sent over the network, from the costs the batch PIR reports.
+type CommStats struct {
+	Batches        uint64 `json:"batches"`        // online batches queried
+	SubQueries     uint64 `json:"subQueries"`     // queries to the partitions those batches made, dummies included
+	OnlineBytes    uint64 `json:"onlineBytes"`    // sent and received by the SubQueries
+	OfflinePhases  uint64 `json:"offlinePhases"`  // the first preprocessing and every maintenance one
+	OfflineBytes   uint64 `json:"offlineBytes"`   // the client streams the whole DB once per offline phase
+	RoundTrips     uint64 `json:"roundTrips"`     // one per batch
+	SimulatedRTTMs uint64 `json:"simulatedRTTMs"` // RoundTrips times -RTT
+}
+
+// NewManifest starts the manifest of a run of stage with config.
+func NewManifest(stage string, config Args) *Manifest {
+	host, _ := os.Hostname()
+	return &Manifest{
+		Stage:     stage,
+		Command:   os.Args,
+		Host:      host,
+		GitCommit: gitCommit(),
+		GoVersion: runtime.Version(),
+		Started:   time.Now(),
+		Config:    config,
+	}
+}
+
+// gitCommit is the commit the binary was built from, with "-dirty" if the tree had changes.
+func gitCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	commit, dirty := "unknown", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			commit = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if dirty {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+// AddInput records the digest of a file the run read. It is an error if it can't be read.
+func (m *Manifest) AddInput(path string) error {
+	d, err := digest(path)
+	if err != nil {
+		return err
+	}
+	m.Inputs = append(m.Inputs, d)
+	return nil
+}
+
+// AddOutput records the digest of a file the run wrote.
+func (m *Manifest) AddOutput(path string) error {
+	d, err := digest(path)
+	if err != nil {
+		return err
+	}
+	m.Outputs = append(m.Outputs, d)
+	return nil
+}
+
+// Note keeps a value that has no field of its own.
+func (m *Manifest) Note(key, value string) {
+	if m.Notes == nil {
+		m.Notes = make(map[string]string)
+	}
+	m.Notes[key] = value
+}
+
+func digest(path string) (FileDigest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return FileDigest{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return FileDigest{Path: path, Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// NewRunDir makes a fresh directory for a run under parent/runs, named after the run and when it started.
+func NewRunDir(parent, name string) (string, error) {
+	runs := filepath.Join(parent, "runs")
+	if err := os.MkdirAll(runs, 0o755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(runs, fmt.Sprintf("%s_%s_", name, time.Now().Format("20060102T150405")))
+}
+
+// Write finishes the manifest and writes it to dir/ManifestFile.
+func (m *Manifest) Write(dir string) (string, error) {
+	m.Finished = time.Now()
+	m.Timings.Total = m.Finished.Sub(m.Started).Seconds()
+	sort.Slice(m.Inputs, func(i, j int) bool { return m.Inputs[i].Path < m.Inputs[j].Path })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, ManifestFile)
+	return path, os.WriteFile(path, data, 0o644)
+}
+
+// ReadManifest reads a manifest written by Write.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,55 @@
+package globals
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	root := t.TempDir()
+	first, err := NewRunDir(root, "search_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewRunDir(root, "search_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || filepath.Dir(first) != filepath.Join(root, "runs") {
+		t.Errorf("runs started together got dirs %s and %s", first, second)
+	}
+
+	input := filepath.Join(root, "qrels.tsv")
+	if err := os.WriteFile(input, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManifest("search", Args{DataName: "test", K: 10})
+	if err := m.AddInput(input); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddInput(filepath.Join(root, "missing")); err == nil {
+		t.Error("missing input got no error")
+	}
+	recall := 0.5
+	m.CandidateRecall = &recall
+	m.Note("fusion", "rrf")
+
+	path, err := m.Write(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "abc"
+	want := FileDigest{input, 3, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	if len(got.Inputs) != 1 || got.Inputs[0] != want {
+		t.Errorf("got inputs %+v, want %+v", got.Inputs, want)
+	}
+	if got.Stage != "search" || got.Config.K != 10 || *got.CandidateRecall != 0.5 || got.Notes["fusion"] != "rrf" ||
+		got.GitCommit == "" || got.Finished.Before(got.Started) {
+		t.Errorf("got %+v", got)
+	}
+}
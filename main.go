@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dkblackley/bins-go/Pacmann"
 	"github.com/dkblackley/bins-go/bins"
+	"github.com/dkblackley/bins-go/bins/rerank"
+	"github.com/dkblackley/bins-go/eval"
+	"github.com/dkblackley/bins-go/fusion"
 	"github.com/dkblackley/bins-go/globals"
 	"github.com/dkblackley/bins-go/pianopir"
 	"github.com/schollz/progressbar/v3"
@@ -25,228 +33,559 @@ type PIRImpliment interface {
 	Preprocess()
 }
 
-func GetDatasets(root, name string) globals.DatasetMetadata {
-	vectors := globals.Vectors{
+// NonPrivateSwitcher is a PIRImpliment that can also answer in plaintext, which -diffPrivate checks PIR against.
+type NonPrivateSwitcher interface {
+	SetNonPrivateMode(nonPrivate bool)
+}
 
-		root + "/Son/my_vectors_192.npy",
-		root + "/Son/query_192_float32.npy",
-		root + "/Son/my_vectors_192_8841823_192_32_graph.npy"}
+// RandSeeder is a PIRImpliment with random sources outside its PIR (dummy indices, random vertices), which a checkpoint
+// carries on by the seed RandSeed restarted them from.
+type RandSeeder interface {
+	RandSeed() int64
+	SetRandSeed(seed int64)
+}
 
-	if name == "msmarco" {
-		return globals.DatasetMetadata{
-			"Marco",
-			root + "/index_marco",
-			root + "/msmarco/corpus.jsonl",
-			root + "/msmarco/queries.dev.small.jsonl",
-			root + "/msmarco/qrels/qrels.dev.tsv",
-			vectors,
-		}
-	} else if name == "scifact" {
-		return globals.DatasetMetadata{
-			"SciFact",
-			root + "/index_scifact", // index folders created earlier
-			root + "/scifact/corpus.jsonl",
-			root + "/scifact/queries.jsonl",
-			root + "/scifact/qrels/test.tsv",
-			vectors,
-		}
-	} else if name == "debug" {
-		logrus.Debugf("Using debug dataset")
-
-		vectors.CorpusVec = root + "/Son/my_vectors_192_debug.npy"
-		vectors.QueryVec = root + "/Son/query_192_float32.npy"
-		vectors.Graph = root + "/Son/debug_graph.npy"
-
-		return globals.DatasetMetadata{
-			"Marco",
-			root + "/index_marco",
-			root + "/msmarco/corpus_debug.jsonl",
-			root + "/msmarco/queries.dev.small_debug.jsonl",
-			root + "/msmarco/qrels/qrels.dev.tsv",
-			vectors,
-		}
-	} else {
-		return globals.DatasetMetadata{
-			"TREC-COVID",
-			root + "/index_trec_covid",
-			root + "/trec-covid/corpus.jsonl",
-			root + "/trec-covid/queries.jsonl",
-			root + "/trec-covid/qrels/test.tsv",
-			vectors,
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd := findCommand(os.Args[1])
+	if cmd == nil {
+		if os.Args[1] != "-h" && os.Args[1] != "-help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
 		}
+		usage()
+		os.Exit(2)
 	}
-}
 
-func main() {
+	config, o := parseFlags(*cmd, os.Args[2:])
+	startRun(*cmd, &config, o)
+	cmd.run(config, o)
+}
 
-	DBSize := flag.Uint("n", 8841823, "Number of items/vectors in DB")
-	searchType := flag.String("t", "bins", "Search type, current options are 'bins'|'pacmann'")
-	dbFileName := flag.String("name", "msmarco", "Identifier for the dataset to be loaded")
-	datasetsDirectory := flag.String("dataset", "../datasets", "Where to look for the dataset/data")
-	topK := flag.Uint("k", 5, "K many items to return in search")
-	vectors := flag.Bool("vectors", true, "Use npy vectors for retrieval or raw text")
-	dimensions := flag.Uint("dim", 192, "Dimension of vectors (if being used)")
-	thresh := flag.Uint("thresh", 0, "Threshold to start dropping items from bins")
-	dChoice := flag.Uint("d", 1, "Number of bins to choose from")
-	binSize := flag.Uint("binSize", 8841823/100, "The number of bins to use")
-	save := flag.Bool("save", false, "Whether or not to save data")
-	load := flag.Bool("load", false, "Whether or not to load data")
-	debugLevel := flag.Int("debug", 1, "Debug level, 0 for info, 1 for debug, 2 for trace and -1 for no debug")
-	checkPointFolder := flag.String("checkpoint", "checkPoint", "Where to look for the checkpoint data")
-	RTT := flag.Uint("RTT", 50, "RTT for the network")
-	outFile := flag.String("outFile", "out.json", "Where to save the answers")
-
-	flag.Parse()
-
-	meta := GetDatasets(*datasetsDirectory, *dbFileName)
-
-	IDLookup := make(map[[32]byte]string) // empty lookup
-
-	config := globals.Args{
-		DatasetsDirectory: *datasetsDirectory,
-		K:                 *topK,
-		SearchType:        *searchType,
-		DataName:          *dbFileName,
-		Vectors:           *vectors,
-		Threshold:         *thresh,
-		DChoice:           *dChoice,
-		BinSize:           *binSize,
-		DBSize:            *DBSize,
-		Save:              *save,
-		Load:              *load,
-		DebugLevel:        *debugLevel,
-		CheckPointFolder:  *checkPointFolder,
-		RTT:               *RTT,
-		Dimensions:        *dimensions,
-		OutFile:           *outFile,
-		QueryNum:          0,
-		DatasetMeta:       meta,
-		IDLookup:          IDLookup,
-		Metadata:          make(map[string]string),
-	}
-
-	switch *debugLevel {
-	case 0:
-		logrus.SetLevel(logrus.InfoLevel)
-	case 1:
-		logrus.SetLevel(logrus.DebugLevel)
-	case 2:
-		logrus.SetLevel(logrus.TraceLevel)
-	default:
-		logrus.SetLevel(logrus.ErrorLevel)
+func runIndex(config globals.Args, o *options) {
+	meta := config.DatasetMeta
+	start := time.Now()
+	indexMeta, err := bins.BuildIndex(meta)
+	if err != nil {
+		logrus.Fatal(err)
 	}
-	logrus.SetReportCaller(true)
+	config.Manifest.Timings.Building = time.Since(start).Seconds()
+	logrus.Infof("Indexed %d docs of %s into %s", indexMeta.Docs, meta.Name, meta.IndexDir)
+	addOutputs(config, filepath.Join(meta.IndexDir, bins.IndexMetadataFile))
+	finishRun(config)
+}
 
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
+func runBuildBins(config globals.Args, o *options) {
+	start := time.Now()
+	binsFiles := bins.BuildBins(config)
+	config.Manifest.Timings.Building = time.Since(start).Seconds()
+	logrus.Infof("Built the bins of %s into %s in %s", config.DatasetMeta.Name, binsFiles[0], time.Since(start))
+	addOutputs(config, binsFiles...)
+	finishRun(config)
+}
 
-	logrus.Debugf("Config: %v", config)
+func runBuildGraph(config globals.Args, o *options) {
+	start := time.Now()
+	graphFile := Pacmann.BuildGraph(config)
+	config.Manifest.Timings.Building = time.Since(start).Seconds()
+	logrus.Infof("Built the graph of %s into %s in %s", config.DatasetMeta.Name, graphFile, time.Since(start))
+	addOutputs(config, graphFile)
+	finishRun(config)
+}
 
-	qids := getQIDS(config)
+// searchQueries returns the QIDs preprocess and search run, nil if there are too few of them to run.
+func searchQueries(config *globals.Args) []string {
+	qids := getQIDS(*config)
 	config.QueryNum = uint(len(qids))
 
 	if config.QueryNum <= 19 {
 		logrus.Errorf("Only %d queries, skipping loaded from %s", config.QueryNum, config.DatasetMeta.Queries)
-		return
+		config.Manifest.Note("skipped", fmt.Sprintf("only %d queries", config.QueryNum))
+		return nil
 	}
+	return qids
+}
+
+// preprocessed sets up the -t PIR over the stored bins and/or graph and runs its offline phase (or loads
+// config.PIRState in its place), putting what it cost in the manifest.
+func preprocessed(config *globals.Args) PIRImpliment {
+	// The bins are built by build-bins
+	config.Load = true
 
 	var PIRImplemented PIRImpliment
 	// TODO: is it sensible to start the 'pre-processing' timer here? If so replace if with switch case!
 
-	if *searchType == "bins" {
-		PIRImplemented = bins.MakeVecDb(config)
-	} else if *searchType == "pacmann" {
-		PIRImplemented = Pacmann.PacmannMain(config)
-	} else {
-		logrus.Errorf("Invalid search type: %s", *searchType)
-		return
+	switch config.SearchType {
+	case "bins":
+		binsDB := bins.MakeVecDb(*config)
+		PIRImplemented = &binsDB
+	case "pacmann":
+		PIRImplemented = Pacmann.PacmannMain(*config)
+	case "hybrid":
+		PIRImplemented = Pacmann.HybridMain(*config)
+	default:
+		logrus.Fatalf("Invalid search type: %s", config.SearchType)
 	}
 
 	start := time.Now()
 	PIRImplemented.Preprocess()
 	end := time.Now()
 	logrus.Infof("Preprocessing finished in %s seconds", end.Sub(start))
-	config.Metadata = PIRImplemented.GetBatchPIRInfo().PrintInfo()
-	config.Metadata["PreprocessingTime"] = end.Sub(start).String()
-	config.Metadata["NumQueries"] = strconv.Itoa(int(config.QueryNum))
+	if config.Private {
+		PIR := PIRImplemented.GetBatchPIRInfo()
+		PIR.PrintInfo()
+		info := PIR.Info()
+		config.Manifest.PIR = &info
+	}
+	config.Manifest.Timings.Preprocessing = end.Sub(start).Seconds()
+	config.Manifest.Queries = int(config.QueryNum)
+	return PIRImplemented
+}
+
+// runPreprocess runs the offline phase and saves the PIR client state it ends in to the run directory, for search.
+func runPreprocess(config globals.Args, o *options) {
+	if searchQueries(&config) == nil {
+		finishRun(config)
+		return
+	}
+	PIRImplemented := preprocessed(&config)
+	if PIR := PIRImplemented.GetBatchPIRInfo(); PIR != nil {
+		path := filepath.Join(config.RunDir, pirStateName(config))
+		var state bytes.Buffer
+		if err := PIR.SaveState(&state); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(path, state.Bytes(), 0o600); err != nil {
+			log.Fatal(err)
+		}
+		logrus.Infof("Saved the PIR client state to %s", path)
+		addOutputs(config, path)
+	}
+	finishRun(config)
+}
+
+// pirStateName is the file preprocess saves the PIR client state to, in its run directory.
+func pirStateName(config globals.Args) string {
+	return fmt.Sprintf("%s_%d.pirstate", config.SearchType, config.K)
+}
+
+// pirStateFile is the PIR client state search loads: -pirState, or else the one of the latest preprocess run of the same
+// -name, -t and -k.
+func pirStateFile(config globals.Args, o *options) (string, error) {
+	if o.pirState != "" {
+		return o.pirState, nil
+	}
+	pattern := filepath.Join(workingDir(config, o), "runs", fmt.Sprintf("preprocess_%s_%s_%d_*", config.DataName,
+		config.SearchType, config.K), pirStateName(config))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+	latest, latestTime := "", time.Time{}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.ModTime().After(latestTime) {
+			latest, latestTime = path, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no PIR state matches %s, run preprocess first (or pass -pirState)", pattern)
+	}
+	return latest, nil
+}
+
+func runSearch(config globals.Args, o *options) {
+	qids := searchQueries(&config)
+	if qids == nil {
+		finishRun(config)
+		return
+	}
+
+	// The PIR client carries on from the checkpoint or else from the state preprocess saved, the offline phase isn't
+	// run again
+	var checkpoint *globals.Checkpoint
+	if config.Resume {
+		checkpoint = resumeCheckpoint(config)
+	}
+	if checkpoint != nil {
+		config.PIRState = checkpoint.PIR
+	} else if config.Private {
+		path, err := pirStateFile(config, o)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if config.PIRState, err = os.ReadFile(path); err != nil {
+			log.Fatal(err)
+		}
+		logrus.Infof("Loading the PIR client state of %s", path)
+		addInputs(config, path)
+	}
+	PIRImplemented := preprocessed(&config)
 
-	start = time.Now()
-	encodedAnswers := doPIRSearch(PIRImplemented, qids, int(config.K), config)
-	end = time.Now()
+	start := time.Now()
+	encodedAnswers := doPIRSearch(PIRImplemented, qids, checkpoint, int(config.K), config)
+	end := time.Now()
 	logrus.Infof("Answers finished in %s seconds", end.Sub(start))
-	config.Metadata["TotalAnswerTime"] = end.Sub(start).String()
+	config.Manifest.Timings.Answering = end.Sub(start).Seconds()
+
+	path := answersFile(config, o)
+	err := globals.SaveEncodedAnswers(path, globals.EncodedAnswers{
+		Dataset:    config.DataName,
+		SearchType: config.SearchType,
+		K:          config.K,
+		Dimensions: config.Dimensions,
+		Answers:    encodedAnswers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	logrus.Infof("Wrote %d encoded answers to %s", len(encodedAnswers), path)
+	addOutputs(config, path)
+
+	// The answers are saved, nothing to resume any more
+	if err := os.Remove(checkpointFile(config)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("Can't remove the checkpoint: %v", err)
+	}
+	finishRun(config)
+}
+
+// answersFile is where search saves the encoded answers and decode reads them from.
+func answersFile(config globals.Args, o *options) string {
+	if o.answers != "" {
+		return o.answers
+	}
+	return fmt.Sprintf("%s_%d.answers", config.SearchType, config.K)
+}
+
+func runDecode(config globals.Args, o *options) {
+	path := answersFile(config, o)
+	encoded, err := globals.LoadEncodedAnswers(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addInputs(config, path)
+	if encoded.SearchType != config.SearchType || encoded.Dataset != config.DataName {
+		logrus.Fatalf("%s holds %s answers of %s, not %s answers of %s", path, encoded.SearchType, encoded.Dataset,
+			config.SearchType, config.DataName)
+	}
+	// Decode them the way they were searched
+	config.K = encoded.K
+	config.Dimensions = encoded.Dimensions
+	// The answers hold rows of the corpus vectors, which are mapped back to doc IDs
+	config.DocIDs, err = bins.LoadDocIDs(config.DatasetMeta.OriginalDir, config.DatasetMeta.Fields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	encodedAnswers := encoded.Answers
 
 	//answers := make(map[string][][]uint64, config.QueryNum)
-	answers := make(map[string][]string, config.QueryNum)
+	answers := make(map[string][]string, len(encodedAnswers))
+	scores := make(map[string][]float64)
 
-	if *searchType == "bins" {
-		IDLookup = bins.MakeLookup(meta, int(*DBSize), int(*dimensions))
-		config.IDLookup = IDLookup
+	var reRanker *rerank.DenseReRanker
+	if config.ReRank != rerank.MetricNone {
+		var err error
+		reRanker, err = rerank.NewDenseReRanker(config, config.ReRank)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Every doc the bins fetched, before they are cut to -k or re-ranked
+	var candidates map[string][]string
+	if config.SearchType == "bins" {
+		candidates = make(map[string][]string, len(encodedAnswers))
 	}
 
+	start := time.Now()
 	bar := progressbar.NewOptions64(
 		int64(len(encodedAnswers)),
 		progressbar.OptionSetDescription("Decoding stuff"),
 		progressbar.OptionShowElapsedTimeOnFinish(),
 	)
 	for qid, encodedAnswer := range encodedAnswers {
-		answers[qid] = encodedAnswer.Decode(config)
 		bar.Add(1)
+		if candidater, ok := encodedAnswer.(rerank.Candidater); ok && (reRanker != nil || candidates != nil) {
+			fetched := candidater.Candidates(config)
+			if candidates != nil {
+				candidates[qid] = make([]string, len(fetched))
+				for i, c := range fetched {
+					candidates[qid][i] = c.DocID
+				}
+			}
+			if reRanker != nil {
+				docIDs, docScores, err := reRanker.ReRank(qid, fetched, int(config.K))
+				if err != nil {
+					logrus.Errorf("Re-ranking QID %s: %v", qid, err)
+					continue
+				}
+				answers[qid] = docIDs
+				scores[qid] = docScores
+				continue
+			}
+		}
+		if scored, ok := encodedAnswer.(globals.ScoredDecodable); ok {
+			answers[qid], scores[qid] = scored.DecodeScored(config)
+			continue
+		}
+		answers[qid] = encodedAnswer.Decode(config)
 	}
 
 	bar.Finish()
+	config.Manifest.Timings.Decoding = time.Since(start).Seconds()
+
+	if candidates != nil {
+		candidateRecall(candidates, config)
+	}
+	config.Manifest.Queries = len(answers)
+
+	writeAnswers(answers, scores, config)
+	finishRun(config)
+}
 
-	writeAnswers(answers, config)
+// loadRun reads the -run answers file of rerank and eval.
+func loadRun(o *options) fusion.Run {
+	if o.run == "" {
+		logrus.Fatalf("Needs the answers file to read in -run")
+	}
+	run, err := fusion.LoadRun(o.run)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return run
+}
 
-	//stringAnwsers := Decode(answers, config)
+func runRerank(config globals.Args, o *options) {
+	run := loadRun(o)
+	addInputs(config, o.run)
+	answers := bins.BasicReRank(run.Docs, config)
+	writeAnswers(answers, nil, config)
+	finishRun(config)
+}
 
-	//if config.DataName != "debug" {
-	bins.BasicReRank(answers, config)
-	//}
+func runEval(config globals.Args, o *options) {
+	run := loadRun(o)
+	addInputs(config, o.run)
+	evaluateAnswers(run.Docs, run.Scores, config)
+	finishRun(config)
+}
 
+func runFuse(config globals.Args, o *options) {
+	fuseAnswers(config, o.fuseFiles, o.fuseMethod, o.fuseWeights)
+	finishRun(config)
 }
 
-func writeAnswers(answers map[string][]string, config globals.Args) {
-	f, err := os.Create(config.OutFile)
+func runCompare(config globals.Args, o *options) {
+	compareAnswers(config, o.compareFiles, o.compareMetrics)
+	finishRun(config)
+}
+
+// candidateRecall logs the recall of the docs the bins fetched and puts it in the manifest, or skips it if the dataset
+// has no qrels.
+func candidateRecall(candidates map[string][]string, config globals.Args) {
+	if config.DatasetMeta.Qrels == "" {
+		logrus.Infof("%s has no qrels, skipping the candidate recall", config.DataName)
+		return
+	}
+	rels, err := eval.LoadQrels(config.DatasetMeta.Qrels)
 	if err != nil {
-		panic(err)
+		logrus.Warnf("Skipping the candidate recall: %v", err)
+		return
 	}
-	defer func(f *os.File) {
-		err := f.Close()
+	recall, err := eval.CandidateRecall(rels, candidates)
+	if err != nil {
+		logrus.Warnf("Skipping the candidate recall: %v", err)
+		return
+	}
+	logrus.Infof("Candidate recall (before re-ranking): %f", recall)
+	config.Manifest.CandidateRecall = &recall
+}
+
+// writeAnswers writes the answers to config.OutFile in config.OutFormat, with their scores if there are any (trec and
+// tsv only), and adds it to the manifest.
+func writeAnswers(answers map[string][]string, scores map[string][]float64, config globals.Args) {
+	switch config.OutFormat {
+	case "trec":
+		if err := eval.WriteRun(config.OutFile, answers, scores, config.SearchType); err != nil {
+			panic(err)
+		}
+	case "tsv":
+		if err := eval.WriteTSV(config.OutFile, answers, scores); err != nil {
+			panic(err)
+		}
+	default:
+		f, err := os.Create(config.OutFile)
 		if err != nil {
+			panic(err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ") // optional
+
+		if err := enc.Encode(answers); err != nil {
+			panic(err)
+		}
+		if err := f.Close(); err != nil {
 			log.Fatal(err)
 		}
-	}(f)
+	}
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ") // optional
+	logrus.Infof("Wrote answers to %s", config.OutFile)
+	addOutputs(config, config.OutFile)
+}
 
-	if err := enc.Encode(answers); err != nil {
-		panic(err)
+// fuseAnswers fuses the answer files of earlier runs, evaluates every input and the fused run, then writes the fused top
+// k like any other search.
+func fuseAnswers(config globals.Args, files, method, weights string) {
+	if files == "" {
+		logrus.Fatalf("fuse needs the answer files to fuse in -fuse")
+	}
+	paths := strings.Split(files, ",")
+
+	var ws []float64
+	if weights != "" {
+		for _, w := range strings.Split(weights, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+			if err != nil {
+				logrus.Fatalf("Bad -fuseWeights %q: %v", weights, err)
+			}
+			ws = append(ws, f)
+		}
+		if len(ws) != len(paths) {
+			logrus.Fatalf("Got %d -fuseWeights for %d -fuse files", len(ws), len(paths))
+		}
 	}
 
-	logrus.Infof("Wrote answers to %s", config.OutFile)
+	rels, err := eval.LoadQrels(config.DatasetMeta.Qrels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ks := evalCutoffs(config)
 
-	f, err = os.Create(fmt.Sprintf("%s_%d_metadata.json", config.SearchType, config.K))
+	runs := make([]fusion.Run, len(paths))
+	for i, path := range paths {
+		run, err := fusion.LoadRun(strings.TrimSpace(path))
+		if err != nil {
+			log.Fatal(err)
+		}
+		addInputs(config, run.Name)
+		if ws != nil {
+			run.Weight = ws[i]
+		}
+		logrus.Infof("%s:\n%s", run.Name, eval.Evaluate(rels, run.Docs, ks))
+		runs[i] = run
+	}
+
+	fused, err := fusion.Fuse(method, runs)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer func(f *os.File) {
-		err := f.Close()
+
+	answers := make(map[string][]string, len(fused.Docs))
+	scores := make(map[string][]float64, len(fused.Docs))
+	for qid, docs := range fused.Docs {
+		n := min(len(docs), int(config.K))
+		answers[qid] = docs[:n]
+		scores[qid] = fused.Scores[qid][:n]
+	}
+
+	logrus.Infof("Fused with %s, top %d:", method, config.K)
+	config.Manifest.Note("fusion", method)
+	if weights != "" {
+		config.Manifest.Note("fuseWeights", weights)
+	}
+
+	evaluateAnswers(answers, scores, config)
+	writeAnswers(answers, scores, config)
+}
+
+// compareAnswers evaluates the answer files of earlier runs and tests every one of them against the first (paired
+// t-test, randomisation test and bootstrap CI), then prints the comparison table and writes it to compare_<k>.txt in
+// the run directory.
+func compareAnswers(config globals.Args, files, metrics string) {
+	paths := strings.Split(files, ",")
+	if files == "" || len(paths) < 2 {
+		logrus.Fatalf("compare needs a baseline and at least one more answer file in -compare")
+	}
+
+	rels, err := eval.LoadQrels(config.DatasetMeta.Qrels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ks := evalCutoffs(config)
+
+	names := make([]string, len(paths))
+	reports := make([]eval.Report, len(paths))
+	for i, path := range paths {
+		run, err := fusion.LoadRun(strings.TrimSpace(path))
 		if err != nil {
 			log.Fatal(err)
 		}
-	}(f)
+		addInputs(config, run.Name)
+		names[i] = run.Name
+		reports[i] = eval.Evaluate(rels, run.Docs, ks)
+	}
+
+	metricNames := eval.MetricNames(ks)
+	if metrics != "" {
+		known := metricNames
+		metricNames = strings.Split(metrics, ",")
+		for _, name := range metricNames {
+			if !slices.Contains(known, name) {
+				logrus.Fatalf("Unknown metric %q in -compareMetrics, options are %v", name, known)
+			}
+		}
+	}
 
-	enc = json.NewEncoder(f)
-	enc.SetIndent("", "  ") // optional
+	// Fixed seed so the randomisation test and bootstrap give the same table every time
+	rng := rand.New(rand.NewSource(config.Seed))
+	table := eval.ComparisonTable(names[0], eval.Compare(names, reports, metricNames, rng))
+	fmt.Print(table)
 
-	if err := enc.Encode(config.Metadata); err != nil {
-		panic(err)
+	tableFile := filepath.Join(config.RunDir, fmt.Sprintf("%s_%d.txt", config.SearchType, config.K))
+	if err := os.WriteFile(tableFile, []byte(table), 0o644); err != nil {
+		log.Fatal(err)
 	}
+	logrus.Infof("Wrote comparison to %s", tableFile)
+	addOutputs(config, tableFile)
+}
 
-	logrus.Infof("Wrote answers to metadata.json")
+// evalCutoffs are the k the answers are evaluated at: 10 (the usual nDCG@10/MRR@10) and -k.
+func evalCutoffs(config globals.Args) []int {
+	if config.K == 10 {
+		return []int{10}
+	}
+	return []int{10, int(config.K)}
+}
+
+// evaluateAnswers scores the answers against the qrels, logs the means and puts them in the manifest, then writes the
+// answers as a TREC run and the per query breakdown as a TREC eval file to the run directory. scores can be empty.
+func evaluateAnswers(answers map[string][]string, scores map[string][]float64, config globals.Args) {
+	rels, err := eval.LoadQrels(config.DatasetMeta.Qrels)
+	if err != nil {
+		logrus.Errorf("Not evaluating, couldn't load qrels: %v", err)
+		return
+	}
+
+	report := eval.Evaluate(rels, answers, evalCutoffs(config))
+	logrus.Infof("Evaluation:\n%s", report)
+	config.Manifest.Metrics = report.Mean
+	config.Manifest.Queries = len(report.PerQuery)
+
+	runFile := filepath.Join(config.RunDir, fmt.Sprintf("%s_%d.run", config.SearchType, config.K))
+	if err := eval.WriteRun(runFile, answers, scores, config.SearchType); err != nil {
+		log.Fatal(err)
+	}
+	evalFile := filepath.Join(config.RunDir, fmt.Sprintf("%s_%d.eval", config.SearchType, config.K))
+	if err := eval.WriteEval(evalFile, report); err != nil {
+		log.Fatal(err)
+	}
+	logrus.Infof("Wrote TREC run to %s and evaluation to %s", runFile, evalFile)
+	addOutputs(config, runFile, evalFile)
 }
 
 func getQIDS(config globals.Args) []string {
@@ -262,16 +601,100 @@ func getQIDS(config globals.Args) []string {
 
 }
 
-func doPIRSearch(PIRImplimented PIRImpliment, qids []string, k int, config globals.Args) map[string]globals.Decodable {
+// checkpointFile is where search saves its checkpoints, one per dataset, type and k.
+func checkpointFile(config globals.Args) string {
+	return filepath.Join(config.CheckPointFolder, fmt.Sprintf("%s_%s_%d.ckpt", config.DataName, config.SearchType,
+		config.K))
+}
+
+// saveCheckpoint saves the answers and the PIR client state of the queries before next.
+func saveCheckpoint(config globals.Args, qids []string, next int, decodables map[string]globals.Decodable,
+	PIRImplimented PIRImpliment, mismatches int, maintainenceTime time.Duration) {
+	start := time.Now()
+	checkpoint := globals.Checkpoint{
+		Dataset:     config.DataName,
+		SearchType:  config.SearchType,
+		K:           config.K,
+		Seed:        config.Seed,
+		QIDs:        qids,
+		Next:        next,
+		Answers:     decodables,
+		Mismatches:  mismatches,
+		Maintenance: maintainenceTime,
+	}
+	if PIR := PIRImplimented.GetBatchPIRInfo(); PIR != nil {
+		var state bytes.Buffer
+		if err := PIR.SaveState(&state); err != nil {
+			log.Fatal(err)
+		}
+		checkpoint.PIR = state.Bytes()
+	}
+	if seeder, ok := PIRImplimented.(RandSeeder); ok {
+		checkpoint.Rand = seeder.RandSeed()
+	}
+
+	path := checkpointFile(config)
+	if err := globals.SaveCheckpoint(path, checkpoint); err != nil {
+		logrus.Errorf("Can't save the checkpoint, carrying on without: %v", err)
+		return
+	}
+	config.Manifest.Timings.Checkpointing += time.Since(start).Seconds()
+	logrus.Debugf("Saved a checkpoint after %d queries to %s in %s", next, path, time.Since(start))
+}
+
+// resumeCheckpoint loads the checkpoint of config and checks it is of the same run. It returns nil if there is no
+// checkpoint; doPIRSearch carries on from it otherwise.
+func resumeCheckpoint(config globals.Args) *globals.Checkpoint {
+	path := checkpointFile(config)
+	checkpoint, err := globals.LoadCheckpoint(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("There is no checkpoint at %s, starting from the first query", path)
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if checkpoint.Dataset != config.DataName || checkpoint.SearchType != config.SearchType || checkpoint.K != config.K {
+		logrus.Fatalf("Checkpoint %s is of %s -t %s -k %d", path, checkpoint.Dataset, checkpoint.SearchType, checkpoint.K)
+	}
+	if (checkpoint.PIR != nil) != config.Private {
+		logrus.Fatalf("Checkpoint %s was of a run with -private=%t", path, checkpoint.PIR != nil)
+	}
+	if checkpoint.Seed != config.Seed {
+		logrus.Warnf("Checkpoint %s was of -seed %d, the setup of this run draws from -seed %d", path, checkpoint.Seed,
+			config.Seed)
+	}
+
+	logrus.Infof("Resuming from %s after %d queries", path, checkpoint.Next)
+	config.Manifest.Note("resumedFrom", fmt.Sprintf("%s after %d queries", path, checkpoint.Next))
+	return &checkpoint
+}
+
+// doPIRSearch answers the queries of qids in order, saving a checkpoint every config.CheckPointEvery queries. Given a
+// checkpoint it starts after the queries in it.
+func doPIRSearch(PIRImplimented PIRImpliment, qids []string, checkpoint *globals.Checkpoint, k int,
+	config globals.Args) map[string]globals.Decodable {
 
 	numQueries := len(qids)
 	//numQueries := 300
 
 	decodables := make(map[string]globals.Decodable)
 	maintainenceTime := time.Duration(0)
+	mismatches := 0
 	PIR := PIRImplimented.GetBatchPIRInfo()
-
-	//start := time.Now()
+	start := 0
+	if checkpoint != nil {
+		if !slices.Equal(checkpoint.QIDs, qids) {
+			logrus.Fatalf("Checkpoint %s was of other queries than %s", checkpointFile(config),
+				config.DatasetMeta.Queries)
+		}
+		if seeder, ok := PIRImplimented.(RandSeeder); ok {
+			seeder.SetRandSeed(checkpoint.Rand)
+		}
+		start = checkpoint.Next
+		decodables, mismatches, maintainenceTime = checkpoint.Answers, checkpoint.Mismatches, checkpoint.Maintenance
+	}
 
 	// TODO REMOVE THIS (?)
 	bar := progressbar.NewOptions64(
@@ -279,7 +702,14 @@ func doPIRSearch(PIRImplimented PIRImpliment, qids []string, k int, config globa
 		progressbar.OptionSetDescription("Answering Queries"),
 		progressbar.OptionShowElapsedTimeOnFinish(),
 	)
-	for i := 0; i < numQueries; i++ {
+	if err := bar.Add(start); err != nil {
+		log.Fatal(err)
+	}
+	for i := start; i < numQueries; i++ {
+
+		if config.CheckPointEvery > 0 && i > start && i%int(config.CheckPointEvery) == 0 {
+			saveCheckpoint(config, qids, i, decodables, PIRImplimented, mismatches, maintainenceTime)
+		}
 
 		err := bar.Add(1)
 		if err != nil {
@@ -287,7 +717,7 @@ func doPIRSearch(PIRImplimented PIRImpliment, qids []string, k int, config globa
 		}
 		q := qids[i]
 
-		if PIR.FinishedBatchNum+PIR.Config().BatchNumNeeded >= PIR.SupportBatchNum { // Do we have enough for the next batch
+		if PIR != nil && PIR.FinishedBatchNum+PIR.Config().BatchNumNeeded >= PIR.SupportBatchNum { // Do we have enough for the next batch
 			// re-run the preprocessing
 			maintainenceTime += PIR.Preprocessing()
 		}
@@ -303,11 +733,36 @@ func doPIRSearch(PIRImplimented PIRImpliment, qids []string, k int, config globa
 
 		decodables[q] = results
 
+		if config.DiffPrivate && !samePlaintextAnswer(PIRImplimented, q, k, results, config) {
+			mismatches++
+		}
+
 	}
 	err := bar.Finish()
 
 	logrus.Infof("Total maintainence time: %s", maintainenceTime)
-	config.Metadata["MaintainenceTime"] = maintainenceTime.String()
+	config.Manifest.Timings.Maintenance = maintainenceTime.Seconds()
+	if PIR != nil {
+		info := PIR.Info()
+		config.Manifest.Comm = &globals.CommStats{
+			Batches:        PIR.BatchesQueried,
+			SubQueries:     PIR.SubQueries,
+			OnlineBytes:    PIR.OnlineBytes,
+			OfflinePhases:  PIR.OfflinePhases,
+			OfflineBytes:   PIR.OfflinePhases * info.DBSizeBytes,
+			RoundTrips:     PIR.BatchesQueried,
+			SimulatedRTTMs: PIR.BatchesQueried * uint64(config.RTT),
+		}
+	}
+
+	if config.DiffPrivate {
+		if mismatches > 0 {
+			logrus.Errorf("%d of %d PIR answers differ from the plaintext ones", mismatches, len(decodables))
+		} else {
+			logrus.Infof("All %d PIR answers match the plaintext ones", len(decodables))
+		}
+		config.Manifest.PrivateMismatches = &mismatches
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -316,6 +771,32 @@ func doPIRSearch(PIRImplimented PIRImpliment, qids []string, k int, config globa
 	return decodables
 }
 
+// samePlaintextAnswer answers QID again in plaintext and reports whether it decodes to the same docs as the PIR answer.
+// Pacmann falls back to random vertices once it runs out of vertices to explore (and hybrid pads its seeds with random
+// ones), so those walks can differ without PIR being wrong.
+func samePlaintextAnswer(PIRImplimented PIRImpliment, QID string, k int, private globals.Decodable,
+	config globals.Args) bool {
+	switcher, ok := PIRImplimented.(NonPrivateSwitcher)
+	if !ok {
+		logrus.Fatalf("-diffPrivate: %T has no plaintext mode", PIRImplimented)
+	}
+
+	switcher.SetNonPrivateMode(true)
+	plain, err := PIRImplimented.DoSearch(QID, k)
+	switcher.SetNonPrivateMode(false)
+	if err != nil {
+		logrus.Errorf("Plaintext search of QID %s: %v", QID, err)
+		return false
+	}
+
+	want, got := plain.Decode(config), private.Decode(config)
+	if !slices.Equal(want, got) {
+		logrus.Warnf("QID %s: PIR answered %v, plaintext %v", QID, got, want)
+		return false
+	}
+	return true
+}
+
 // For degugging, return the first n elements.
 //func FirstN[T any](xs []T, n int) []T {
 //	if len(xs) <= n {
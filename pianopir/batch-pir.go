@@ -50,6 +50,10 @@ type SimpleBatchPianoPIR struct {
 	FinishedBatchNum        uint64
 	QueriesMadeInPartition  uint64
 	SupportBatchNum         uint64
+	BatchesQueried          uint64  // Query calls over the lifetime of the PIR, one round trip each
+	OfflinePhases           uint64  // Preprocessing calls, the first one and every rerun once the hints ran out
+	SubQueries              uint64  // queries to the partitions (real and dummy) over the lifetime of the PIR
+	OnlineBytes             uint64  // what those SubQueries sent and got back
 	localStorage            uint64  // bytes
 	preprocessingTime       float64 // seconds
 	commCostPerBatchOnline  uint64  // bytes
@@ -165,6 +169,55 @@ func (p *SimpleBatchPianoPIR) PrintInfo() map[string]string {
 	return metadata
 }
 
+// Info is the setup of a batch PIR and what it costs, the numbers PrintInfo prints.
+type Info struct {
+	DBSizeBytes           uint64  `json:"dbSizeBytes"`
+	DBEntryByteNum        uint64  `json:"dbEntryByteNum"`
+	BatchSize             uint64  `json:"batchSize"`
+	PartitionNum          uint64  `json:"partitionNum"`
+	PartitionSize         uint64  `json:"partitionSize"`
+	ChunkSize             uint64  `json:"chunkSize"`
+	SetSize               uint64  `json:"setSize"`
+	ThreadNum             uint64  `json:"threadNum"`
+	FailureProbLog2       uint64  `json:"failureProbLog2"`
+	MaxBatches            uint64  `json:"maxBatches"` // batches before the hints run out
+	ClientStorageBytes    uint64  `json:"clientStorageBytes"`
+	OnlineBytesPerBatch   uint64  `json:"onlineBytesPerBatch"`
+	OfflineBytesAmortized float64 `json:"offlineBytesPerBatchAmortized"`
+}
+
+// Info returns the setup and costs of the PIR, it has to be preprocessed first.
+func (p *SimpleBatchPianoPIR) Info() Info {
+	DBSizeInBytes := uint64(0)
+	for i := uint64(0); i < p.config.PartitionNum; i++ {
+		for _, v := range p.subPIR[i].server.rawDB {
+			DBSizeInBytes += uint64(len(v)) * 8
+		}
+	}
+	PIR := p.subPIR[0]
+	maxQuery := PIR.client.MaxQueryNum / QueryPerPartition
+	amortized := 0.0
+	if maxQuery > 0 { // Tiny DBs have hints for less than a batch
+		amortized = float64(DBSizeInBytes) / float64(maxQuery)
+	}
+
+	return Info{
+		DBSizeBytes:           DBSizeInBytes,
+		DBEntryByteNum:        p.config.DBEntryByteNum,
+		BatchSize:             p.config.BatchSize,
+		PartitionNum:          p.config.PartitionNum,
+		PartitionSize:         p.config.PartitionSize,
+		ChunkSize:             PIR.config.ChunkSize,
+		SetSize:               PIR.config.SetSize,
+		ThreadNum:             p.config.ThreadNum,
+		FailureProbLog2:       p.config.FailureProbLog2,
+		MaxBatches:            maxQuery,
+		ClientStorageBytes:    uint64(p.LocalStorageSize()),
+		OnlineBytesPerBatch:   p.CommCostPerBatchOnline(),
+		OfflineBytesAmortized: amortized,
+	}
+}
+
 func (p *SimpleBatchPianoPIR) RecordStats(prepTime float64) {
 	p.preprocessingTime = prepTime
 	p.localStorage = uint64(p.LocalStorageSize())                 // bytes
@@ -183,6 +236,7 @@ func (p *SimpleBatchPianoPIR) Preprocessing() time.Duration {
 	// we now use p.config.ThreadNum threads to do the preprocessing
 	p.FinishedBatchNum = 0
 	p.QueriesMadeInPartition = 0
+	p.OfflinePhases++
 	startTime := time.Now()
 
 	var wg sync.WaitGroup
@@ -228,6 +282,7 @@ func (p *SimpleBatchPianoPIR) DummyPreprocessing() {
 /// TODO: optimize for multiple batch
 
 func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
+	p.BatchesQueried++
 
 	// first identify in average how many queries in each partition we need to make
 
@@ -268,6 +323,8 @@ func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
 
 		// now we make queryNumToMake queries to the sub PIR
 		for j := uint64(0); j < uint64(queryNumToMake); j++ {
+			p.SubQueries++
+			p.OnlineBytes += uint64(p.subPIR[i].CommCostPerQuery())
 			if partitionQueries[i][j] == DefaultValue {
 				_, _ = p.subPIR[i].Query(0, false) // just make a dummy query
 			} else {
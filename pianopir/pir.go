@@ -6,8 +6,6 @@ import (
 
 	"log"
 	"math"
-	"math/rand"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -162,11 +160,8 @@ func primaryNumParam(Q float64, ChunkSize float64, target uint64) uint64 {
 // NewPianoPIRClient is an initialization function for the client
 func NewPianoPIRClient(config *PianoPIRConfig) *PianoPIRClient {
 
-	seed := time.Now().UnixNano()
-	rng := rand.New(rand.NewSource(seed))
-	masterKey := RandKey(rng)
+	masterKey := SecretKey()
 	longKey := GetLongKey((*PrfKey128)(&masterKey))
-	//seed := int64(1678852332934430000)
 
 	maxQueryNum := uint64(math.Sqrt(float64(config.DBSize)) * math.Log(float64(config.DBSize)))
 	primaryHintNum := primaryNumParam(float64(maxQueryNum), float64(config.ChunkSize), config.FailureProbLog2+1) // fail prob 2^(-41)
@@ -184,7 +179,7 @@ func NewPianoPIRClient(config *PianoPIRConfig) *PianoPIRClient {
 	//fmt.Printf("primaryHintNum = %v\n", primaryHintNum)
 	//fmt.Printf("maxQueryPerChunk = %v\n", maxQueryPerChunk)
 
-	masterKey = RandKey(rng)
+	masterKey = SecretKey()
 	return &PianoPIRClient{
 		config:   config,
 		skipPrep: false, // default to false
@@ -246,9 +241,7 @@ func (c *PianoPIRClient) Initialization() {
 	c.FinishedQueryNum = 0
 
 	// resample the key
-	seed := time.Now().UnixNano()
-	rng := rand.New(rand.NewSource(seed))
-	c.masterKey = RandKey(rng)
+	c.masterKey = SecretKey()
 	c.longKey = GetLongKey((*PrfKey128)(&c.masterKey))
 
 	c.QueryHistogram = make([]uint64, c.config.SetSize)
@@ -383,9 +376,8 @@ func EntryXor(a, b [][]uint64) {
 //
 //}
 
-func (c *PianoPIRClient) Preprocessing(rawDB [][]uint64) [][]uint64 {
-	c.Initialization() // first clean everything
-
+// padDB appends zero entries to rawDB up to whole chunks, which the offline phase and the server's answers expect.
+func (c *PianoPIRClient) padDB(rawDB [][]uint64) [][]uint64 {
 	if len(rawDB) < int(c.config.ChunkSize*c.config.SetSize) {
 		// append with zeros
 		prev_len := len(rawDB)
@@ -397,6 +389,12 @@ func (c *PianoPIRClient) Preprocessing(rawDB [][]uint64) [][]uint64 {
 			}
 		}
 	}
+	return rawDB
+}
+
+func (c *PianoPIRClient) Preprocessing(rawDB [][]uint64) [][]uint64 {
+	c.Initialization() // first clean everything
+	rawDB = c.padDB(rawDB)
 
 	if c.skipPrep {
 		// only for debugging and benchmarking
@@ -443,9 +441,6 @@ func (c *PianoPIRClient) Preprocessing(rawDB [][]uint64) [][]uint64 {
 
 func (c *PianoPIRClient) UpdatePreprocessing(chunkId uint64, chunk [][]uint64) {
 
-	seed := time.Now().UnixNano()
-	rng := rand.New(rand.NewSource(seed))
-
 	// if len(chunk) < int(c.config.ChunkSize*c.config.DBEntrySize) {
 	if len(chunk) < int(c.config.ChunkSize) {
 		fmt.Println("not enough chunk size")
@@ -489,7 +484,7 @@ func (c *PianoPIRClient) UpdatePreprocessing(chunkId uint64, chunk [][]uint64) {
 	// finally store the replacement
 
 	for j := uint64(0); j < c.maxQueryPerChunk; j++ {
-		offset := rng.Uint64() & (c.config.ChunkSize - 1)
+		offset := secretUint64() & (c.config.ChunkSize - 1)
 		c.replacementIdx[chunkId][j] = offset + chunkId*c.config.ChunkSize
 		copy(c.replacementVal[chunkId][j:(j+1)], chunk[offset:(offset+1)])
 	}
@@ -510,7 +505,7 @@ func (c *PianoPIRClient) Query(idx uint64, server *PianoPIRServer, realQuery boo
 	if !realQuery {
 		offsets := make([]uint32, c.config.SetSize)
 		for i := uint64(0); i < c.config.SetSize; i++ {
-			offsets[i] = uint32(rand.Uint64() & (c.config.ChunkSize - 1))
+			offsets[i] = uint32(secretUint64() & (c.config.ChunkSize - 1))
 		}
 		_, err := server.PrivateQuery(offsets)
 
@@ -681,6 +676,11 @@ func (p *PianoPIR) Preprocessing() {
 	p.server.rawDB = p.client.Preprocessing(p.server.rawDB)
 }
 
+// setupServer gives the server its own padded copy of the DB like Preprocessing does, but leaves the client alone.
+func (p *PianoPIR) setupServer() {
+	p.server.rawDB = p.client.padDB(DeepCopy2DUint64(p.server.rawDB))
+}
+
 func (p *PianoPIR) DummyPreprocessing() {
 	p.client.Initialization()
 	p.client.skipPrep = true
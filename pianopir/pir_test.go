@@ -1,8 +1,10 @@
 package pianopir
 
 import (
+	"bytes"
 	"math"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 )
@@ -125,7 +127,7 @@ func TestBatchPIRBasic(t *testing.T) {
 		rawDB[i] = entry
 	}
 
-	PIR := NewSimpleBatchPianoPIR(DBSize, MaxDBEntrySize, DBEntrySize, BatchSize, rawDB, 40)
+	PIR := NewSimpleBatchPianoPIR(DBSize, MaxDBEntrySize, DBEntrySize, BatchSize, rawDB, 40, 1)
 
 	// print the config of the PIR
 	config := PIR.Config()
@@ -294,7 +296,7 @@ func TestBatchPIRPerf(t *testing.T) {
 		rawDB[i] = entry
 	}
 
-	PIR := NewSimpleBatchPianoPIR(DBSize, MaxDBEntrySize, DBEntrySize, BatchSize, rawDB, 40)
+	PIR := NewSimpleBatchPianoPIR(DBSize, MaxDBEntrySize, DBEntrySize, BatchSize, rawDB, 40, 1)
 
 	// print the config of the PIR
 	config := PIR.Config()
@@ -473,3 +475,83 @@ func TestAESPerf(t *testing.T) {
 	t.Logf("XorSlices time = %v\n", end.Sub(start))
 	t.Logf("average time = %v ns", end.Sub(start).Nanoseconds()/int64(n))
 }
+
+func TestBatchPIRKeys(t *testing.T) {
+	DBSize := uint64(1024)
+	rawDB := make([][]uint64, DBSize)
+	for i := range rawDB {
+		rawDB[i] = []uint64{uint64(i), uint64(i) * 3}
+	}
+	// The keys come from crypto/rand, two clients over the same DB (from the same -seed) can't share them
+	first := NewSimpleBatchPianoPIR(DBSize, 2, 16, 16, rawDB, 40, 1)
+	again := NewSimpleBatchPianoPIR(DBSize, 2, 16, 16, rawDB, 40, 1)
+	first.Preprocessing()
+	again.Preprocessing()
+	keys := make(map[PrfKey]bool)
+	for _, PIR := range []*SimpleBatchPianoPIR{first, again} {
+		for i, sub := range PIR.subPIR {
+			if keys[sub.client.masterKey] {
+				t.Errorf("partition %d has a master key seen before", i)
+			}
+			keys[sub.client.masterKey] = true
+		}
+	}
+}
+
+func TestBatchPIRState(t *testing.T) {
+	DBSize := uint64(1024)
+	rawDB := make([][]uint64, DBSize)
+	for i := range rawDB {
+		rawDB[i] = []uint64{uint64(i), uint64(i) * 3}
+	}
+	query := func(PIR *SimpleBatchPianoPIR, batch []uint64) {
+		t.Helper()
+		responses, err := PIR.Query(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, idx := range batch {
+			if responses[i][0] != rawDB[idx][0] || responses[i][1] != rawDB[idx][1] {
+				t.Fatalf("query %d got %v", idx, responses[i])
+			}
+		}
+	}
+
+	saved := NewSimpleBatchPianoPIR(DBSize, 2, 16, 16, rawDB, 40, 1)
+	saved.Preprocessing()
+	query(saved, []uint64{1, 200, 700})
+	var state bytes.Buffer
+	if err := saved.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading takes the place of the offline phase
+	loaded := NewSimpleBatchPianoPIR(DBSize, 2, 16, 16, rawDB, 40, 1)
+	if err := loaded.PreprocessingFrom(state.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// One query in each of 3 of the 8 partitions, and a dummy in each of the others
+	if loaded.BatchesQueried != 1 || loaded.SubQueries != 8 || loaded.OfflinePhases != 1 {
+		t.Errorf("loaded %d batches, %d sub-queries and %d offline phases, want 1, 8 and 1", loaded.BatchesQueried,
+			loaded.SubQueries, loaded.OfflinePhases)
+	}
+	if want := 8 * uint64(loaded.subPIR[0].CommCostPerQuery()); loaded.OnlineBytes != want {
+		t.Errorf("loaded %d online bytes, want %d", loaded.OnlineBytes, want)
+	}
+
+	// Both carry on with the same keys, and the same hints used up
+	for _, PIR := range []*SimpleBatchPianoPIR{saved, loaded} {
+		query(PIR, []uint64{2, 201, 900})
+	}
+	for i := range saved.subPIR {
+		a, b := saved.subPIR[i].client, loaded.subPIR[i].client
+		if a.FinishedQueryNum != b.FinishedQueryNum || a.masterKey != b.masterKey {
+			t.Errorf("partition %d differs after loading", i)
+		}
+	}
+
+	other := NewSimpleBatchPianoPIR(DBSize/2, 2, 16, 16, rawDB[:DBSize/2], 40, 1)
+	if err := other.LoadState(bytes.NewReader(state.Bytes())); err == nil || !strings.Contains(err.Error(), "DB size") {
+		t.Errorf("loading into a PIR over another DB got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package pianopir
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// clientState is everything a PianoPIRClient has learnt in its offline phase and what its queries have used up since.
+type clientState struct {
+	SkipPrep         bool
+	MasterKey        PrfKey
+	MaxQueryNum      uint64
+	FinishedQueryNum uint64
+	MaxQueryPerChunk uint64
+	QueryHistogram   []uint64
+
+	PrimaryHintNum      uint64
+	PrimaryShortTag     []uint64
+	PrimaryParity       [][]uint64
+	PrimaryProgramPoint []uint64
+	ReplacementIdx      [][]uint64
+	ReplacementVal      [][][]uint64
+	BackupShortTag      [][]uint64
+	BackupParity        [][][]uint64
+	LocalCache          map[uint64][][]uint64
+}
+
+// batchState is the client side of a SimpleBatchPianoPIR, see SaveState.
+type batchState struct {
+	DBSize       uint64
+	PartitionNum uint64
+	BatchSize    uint64
+
+	FinishedBatchNum       uint64
+	QueriesMadeInPartition uint64
+	SupportBatchNum        uint64
+	BatchesQueried         uint64
+	OfflinePhases          uint64
+	SubQueries             uint64
+	OnlineBytes            uint64
+	Clients                []clientState
+}
+
+func (c *PianoPIRClient) state() clientState {
+	return clientState{
+		SkipPrep:            c.skipPrep,
+		MasterKey:           c.masterKey,
+		MaxQueryNum:         c.MaxQueryNum,
+		FinishedQueryNum:    c.FinishedQueryNum,
+		MaxQueryPerChunk:    c.maxQueryPerChunk,
+		QueryHistogram:      c.QueryHistogram,
+		PrimaryHintNum:      c.primaryHintNum,
+		PrimaryShortTag:     c.primaryShortTag,
+		PrimaryParity:       c.primaryParity,
+		PrimaryProgramPoint: c.primaryProgramPoint,
+		ReplacementIdx:      c.replacementIdx,
+		ReplacementVal:      c.replacementVal,
+		BackupShortTag:      c.backupShortTag,
+		BackupParity:        c.backupParity,
+		LocalCache:          c.localCache,
+	}
+}
+
+func (c *PianoPIRClient) setState(s clientState) {
+	c.skipPrep = s.SkipPrep
+	c.masterKey = s.MasterKey
+	c.longKey = GetLongKey((*PrfKey128)(&c.masterKey))
+	c.MaxQueryNum = s.MaxQueryNum
+	c.FinishedQueryNum = s.FinishedQueryNum
+	c.maxQueryPerChunk = s.MaxQueryPerChunk
+	c.QueryHistogram = s.QueryHistogram
+	c.primaryHintNum = s.PrimaryHintNum
+	c.primaryShortTag = s.PrimaryShortTag
+	c.primaryParity = s.PrimaryParity
+	c.primaryProgramPoint = s.PrimaryProgramPoint
+	c.replacementIdx = s.ReplacementIdx
+	c.replacementVal = s.ReplacementVal
+	c.backupShortTag = s.BackupShortTag
+	c.backupParity = s.BackupParity
+	c.localCache = s.LocalCache
+	if c.localCache == nil { // gob leaves out empty maps
+		c.localCache = make(map[uint64][][]uint64)
+	}
+}
+
+// SaveState writes the client state of the PIR (the hints, the keys and how much of them the queries have used) to w.
+// LoadState on a PIR over the same DB carries on from there. This is the only place the keys leave the client (they
+// come from crypto/rand, not a seed): whoever reads what was written can tell which indices were queried, so it is as
+// secret as the client itself.
+func (p *SimpleBatchPianoPIR) SaveState(w io.Writer) error {
+	s := batchState{
+		DBSize:                 p.config.DBSize,
+		PartitionNum:           p.config.PartitionNum,
+		BatchSize:              p.config.BatchSize,
+		FinishedBatchNum:       p.FinishedBatchNum,
+		QueriesMadeInPartition: p.QueriesMadeInPartition,
+		SupportBatchNum:        p.SupportBatchNum,
+		BatchesQueried:         p.BatchesQueried,
+		OfflinePhases:          p.OfflinePhases,
+		SubQueries:             p.SubQueries,
+		OnlineBytes:            p.OnlineBytes,
+		Clients:                make([]clientState, len(p.subPIR)),
+	}
+	for i, sub := range p.subPIR {
+		s.Clients[i] = sub.client.state()
+	}
+	return gob.NewEncoder(w).Encode(s)
+}
+
+// LoadState reads the client state written by SaveState, in place of an offline phase: the server side is set up as
+// Preprocessing would, but the hints are the saved ones. It can also replace the hints of a PIR that was preprocessed.
+func (p *SimpleBatchPianoPIR) LoadState(r io.Reader) error {
+	var s batchState
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.DBSize != p.config.DBSize || s.PartitionNum != p.config.PartitionNum || s.BatchSize != p.config.BatchSize ||
+		len(s.Clients) != len(p.subPIR) {
+		return fmt.Errorf("saved PIR has DB size %d, %d partitions and batches of %d, this one %d, %d and %d",
+			s.DBSize, s.PartitionNum, s.BatchSize, p.config.DBSize, p.config.PartitionNum, p.config.BatchSize)
+	}
+
+	p.FinishedBatchNum = s.FinishedBatchNum
+	p.QueriesMadeInPartition = s.QueriesMadeInPartition
+	p.SupportBatchNum = s.SupportBatchNum
+	p.BatchesQueried = s.BatchesQueried
+	p.OfflinePhases = s.OfflinePhases
+	p.SubQueries = s.SubQueries
+	p.OnlineBytes = s.OnlineBytes
+	for i, sub := range p.subPIR {
+		sub.setupServer()
+		sub.client.setState(s.Clients[i])
+	}
+	return nil
+}
+
+// PreprocessingFrom loads state with LoadState, or runs the offline phase if state is nil.
+func (p *SimpleBatchPianoPIR) PreprocessingFrom(state []byte) error {
+	if state == nil {
+		p.Preprocessing()
+		return nil
+	}
+	return p.LoadState(bytes.NewReader(state))
+}
@@ -10,7 +10,9 @@ import (
 	//"crypto/aes"
 	//"crypto/cipher"
 
+	crand "crypto/rand"
 	"encoding/binary"
+	"log"
 	rand "math/rand"
 )
 
@@ -34,6 +36,24 @@ func RandKey(rng *rand.Rand) PrfKey {
 	return PrfKey(RandKey128(rng))
 }
 
+// SecretKey draws a key from crypto/rand. The client's keys never come from a seeded source, the seed isn't secret.
+func SecretKey() PrfKey {
+	var key PrfKey
+	if _, err := crand.Read(key[:]); err != nil {
+		log.Fatalf("could not draw a key: %v", err)
+	}
+	return key
+}
+
+// secretUint64 draws a number from crypto/rand, for the indices the server must not be able to predict.
+func secretUint64() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		log.Fatalf("could not draw a random number: %v", err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
 func PRFEval(key *PrfKey, x uint64) uint64 {
 	return PRFEval4((*PrfKey128)(key), x)
 }